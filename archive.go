@@ -0,0 +1,117 @@
+package main
+
+// archive_command mode, for servers that don't allow replication
+// connections: postgres hands us every finished segment instead
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log/slog"
+	"os"
+	"strings"
+)
+
+// Archive is the archive_command, it uploads the file at path postgres
+// calls name (%p and %f). It fails, so postgres retries, unless the file is
+// in storage, which it also is when it was archived (or streamed) before
+// with the same contents.
+func Archive(path, name string) error {
+	if strings.HasSuffix(name, ".partial") {
+		// written on promotion, recovery doesn't use it
+		slog.Info("not archiving partial segment", "file", name)
+		return nil
+	}
+	file, ok := archiveObject(name)
+	if !ok {
+		return errors.New("not a wal segment or history file: " + name)
+	}
+	d, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	s, segment := parseSegmentName(name)
+	if segment {
+		err = checkSegment(d, s.Lsn())
+		if err != nil {
+			return fmt.Errorf("%s: %s", name, err)
+		}
+	}
+
+	backend, err := Connect()
+	if err != nil {
+		return err
+	}
+	defer backend.Close()
+
+	stored, err := storedAs(backend, file, d)
+	if err != nil || stored {
+		if stored {
+			slog.Info("archived before", "file", name, "object", file)
+		}
+		return err
+	}
+
+	size, _, encSum := sums(file, d)
+	err = backend.retry(func() error {
+		var err error
+		if segment {
+			// one at a time, the commits in records continued from the
+			// segment before aren't indexed
+			err = putSegment(backend, s, d, newIndexer(s.Lsn()))
+		} else {
+			err = putObject(backend, file, d)
+		}
+		if err != nil {
+			return err
+		}
+		err = backend.confirm(file, size, encSum)
+		if err != nil {
+			return err
+		}
+		missing, err := backend.confirmPending()
+		if err == nil && len(missing) > 0 {
+			err = errors.New(file + " not stored")
+		}
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	slog.Info("archived", "file", name, "object", file, "bytes", size)
+	return nil
+}
+
+// fetchHistory is the restore_command for timeline history files
+func fetchHistory(name, target string) error {
+	var timeline int
+	if n, _ := fmt.Sscanf(name, "%08X.history", &timeline); n != 1 || len(name) != 16 || timeline == 0 {
+		return errors.New("invalid history file: " + name)
+	}
+	backend, err := Connect()
+	if err != nil {
+		return err
+	}
+	defer backend.Close()
+
+	d, err := getObject(backend, historyFile(timeline))
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(target, d, 0600)
+}
+
+// controlSystemId reads the systemId from the global/pg_control of a data
+// directory
+func controlSystemId(dir string) (uint64, error) {
+	f, err := os.Open(dir + "/global/pg_control")
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	var d [8]byte
+	_, err = io.ReadFull(f, d[:])
+	return binary.LittleEndian.Uint64(d[:]), err // ControlFileData.system_identifier
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestArchiveObject(t *testing.T) {
+	for name, want := range map[string]string{
+		"000000020000000100000003":                 "0000000000000103.2.wal",
+		"00000002.history":                         "00000002.history",
+		"0000000100000000000000A1.00000028.backup": "00000000000000a1.1.00000028.backup",
+		"000000010000000000000001.partial":         "",
+		"00000000.history":                         "",
+		"archive_status":                           "",
+	} {
+		if got, _ := archiveObject(name); got != want {
+			t.Errorf("%s: %q, want %q", name, got, want)
+		}
+	}
+}
+
+func TestArchive(t *testing.T) {
+	b := startBackend(t)
+	dir := t.TempDir()
+	name := segmentName(1, 5<<24)
+	path := filepath.Join(dir, name)
+	ioutil.WriteFile(path, testSegment(5<<24), 0600)
+
+	err := Archive(path, name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file := walSegment{5, 1}.File()
+	if !bytes.Equal(b.decrypted(t, file), testSegment(5<<24)) {
+		t.Error("wrong contents")
+	}
+	if _, ok := b.file(indexFile(5, 1)); !ok {
+		t.Error("no index")
+	}
+
+	// postgres retries after a crash, or the stream got it
+	err = Archive(path, name)
+	if err != nil {
+		t.Errorf("archived again: %v", err)
+	}
+	d := testSegment(5 << 24)
+	d[100] = 1
+	ioutil.WriteFile(path, d, 0600)
+	err = Archive(path, name)
+	if err == nil || !strings.Contains(err.Error(), "other contents") {
+		t.Errorf("archived other contents: %v", err)
+	}
+
+	// the stream stored the start of it
+	seg := testSegment(6 << 24)
+	name6 := segmentName(1, 6<<24)
+	path6 := filepath.Join(dir, name6)
+	ioutil.WriteFile(path6, seg, 0600)
+	b.putEncrypted(walSegment{6, 1}.File(), seg[:3*8192])
+	err = Archive(path6, name6)
+	if err != nil {
+		t.Fatalf("partial segment in storage: %v", err)
+	}
+	if !bytes.Equal(b.decrypted(t, walSegment{6, 1}.File()), seg) {
+		t.Error("partial segment not replaced")
+	}
+	short := append([]byte(nil), seg[:3*8192]...)
+	short[100] = 1
+	b.putEncrypted(walSegment{6, 1}.File(), short)
+	err = Archive(path6, name6)
+	if err == nil || !strings.Contains(err.Error(), "other contents") {
+		t.Errorf("archived over a short segment with other contents: %v", err)
+	}
+
+	// not ours, or not where its name says
+	err = Archive(path, segmentName(1, 6<<24))
+	if err == nil || !strings.Contains(err.Error(), "expected") {
+		t.Errorf("archived misnamed segment: %v", err)
+	}
+
+	// timeline history, for restore_command
+	history := []byte("1\t0/5000100\tno recovery target specified\n")
+	path = filepath.Join(dir, "00000002.history")
+	ioutil.WriteFile(path, history, 0600)
+	err = Archive(path, "00000002.history")
+	if err != nil {
+		t.Fatal(err)
+	}
+	target := filepath.Join(t.TempDir(), "RECOVERYHISTORY")
+	err = Fetch("00000002.history", target)
+	if d, _ := ioutil.ReadFile(target); err != nil || !bytes.Equal(d, history) {
+		t.Errorf("fetched history %q, %v", d, err)
+	}
+	if err := Fetch("00000003.history", target); err == nil {
+		t.Error("fetched a missing history file")
+	}
+}
@@ -1,7 +1,7 @@
 package main
 
 import (
-	"bytes"
+	"bufio"
 	"crypto/ecdsa"
 	"crypto/elliptic"
 	"crypto/rand"
@@ -9,19 +9,54 @@ import (
 	"crypto/tls"
 	"crypto/x509"
 	"crypto/x509/pkix"
+	"encoding/base64"
 	"encoding/binary"
 	"encoding/pem"
+	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
+	"log/slog"
 	"math/big"
 	"net"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
 )
 
+// Backend is a connection to the backend. Replies come in the order of the
+// requests, so several gets can be in flight on one connection.
 type Backend struct {
-	C net.Conn
+	C        net.Conn
+	rd       *bufio.Reader
+	failures int      // connection failures since the last good reply
+	s        *storage // where to (re)connect to
+	noStat   bool     // the backend replied unknownCommand to pgbackup.stat
+	pending  []string // put and not confirmed yet, without pgbackup.stat
 }
 
-func Connect() (*Backend, error) {
+const (
+	backendRetries = 3  // reconnects before a get or list gives up
+	getWindow      = 16 // gets in flight in GetAll
+)
+
+const defaultEndpoint = "pgbackup.com:54321"
+
+// accountId is how the backend identifies us, from the public key of our
+// client certificate
+func accountId(pub interface{}) (string, error) {
+	der, err := x509.MarshalPKIXPublicKey(pub)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(der)
+	return base64.RawURLEncoding.EncodeToString(sum[0:12]), nil
+}
+
+// clientKey derives the key of our client certificate, and so our account
+func clientKey() (*ecdsa.PrivateKey, error) {
 
 	// To deterministically create a ecdsa private key on the P256() curve, we
 	// need 40 bytes of entropy: 256/8+8: https://golang.org/src/crypto/ecdsa/ecdsa.go#L89
@@ -32,16 +67,48 @@ func Connect() (*Backend, error) {
 	copy(material[0:32], material0[:])
 	binary.BigEndian.PutUint64(material[32:40], config.SystemId)
 
-	key, err := ecdsa.GenerateKey(elliptic.P256(), bytes.NewReader(material[:]))
+	// newer go reads a random extra byte in GenerateKey, so we derive the key
+	// like it used to: k = material mod (N-1) + 1
+	curve := elliptic.P256()
+	one := big.NewInt(1)
+	k := new(big.Int).SetBytes(material[:])
+	k.Mod(k, new(big.Int).Sub(curve.Params().N, one))
+	k.Add(k, one)
+
+	key := &ecdsa.PrivateKey{D: k}
+	key.Curve = curve
+	key.X, key.Y = curve.ScalarBaseMult(k.Bytes())
+	return key, nil
+}
+
+// Connect connects to the backend of pgbackup.conf
+func Connect() (*Backend, error) {
+	return ConnectTo(&config.storage)
+}
+
+// ConnectTo connects to the backend of storage s
+func ConnectTo(s *storage) (*Backend, error) {
+	b := &Backend{s: s}
+	err := b.connect()
 	if err != nil {
 		return nil, err
 	}
+	return b, nil
+}
 
-	// might be useful to debug client/server account mismatch:
-	//account0, _ := x509.MarshalPKIXPublicKey(&key.PublicKey)
-	//account1 := sha256.Sum256(account0)
-	//account := base64.RawURLEncoding.EncodeToString(account1[0:12])
-	//log.Print("clientAccount: ", account)
+func (b *Backend) connect() error {
+	if b.s.Dir != "" {
+		return b.connectDir()
+	}
+
+	key, err := clientKey()
+	if err != nil {
+		return err
+	}
+
+	// might be useful to debug client/server account mismatch
+	account, _ := accountId(&key.PublicKey)
+	slog.Debug("backend account", "account", account)
 
 	cert := x509.Certificate{
 		SerialNumber: big.NewInt(1),
@@ -57,64 +124,387 @@ func Connect() (*Backend, error) {
 		pem.EncodeToMemory(&pem.Block{Type: "ECDSA PRIVATE KEY", Bytes: der1}),
 	)
 	if err != nil {
-		return nil, err
+		return err
 	}
 
-	conn, err := tls.Dial("tcp", "pgbackup.com:54321", &tls.Config{
-		CipherSuites: []uint16{tls.TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA},
-		Certificates: []tls.Certificate{tlsCert},
-	})
+	endpoint := b.s.Endpoint
+	if endpoint == "" {
+		endpoint = defaultEndpoint
+	}
+	tlsConfig, err := backendTLSConfig(b.s, endpoint)
 	if err != nil {
-		return nil, err
+		return err
+	}
+	tlsConfig.Certificates = []tls.Certificate{tlsCert}
+
+	c, err := dialBackend(b.s.Proxy, endpoint)
+	if err != nil {
+		return backendErr(err)
+	}
+	conn := tls.Client(c, tlsConfig)
+	c.SetDeadline(time.Now().Add(dialTimeout))
+	err = conn.Handshake()
+	if err != nil {
+		c.Close()
+		return backendErr(err)
 	}
+	c.SetDeadline(time.Time{})
 
-	b := &Backend{C: conn}
+	b.C = conn
+	b.rd = bufio.NewReaderSize(conn, 64*1024)
 
 	err = b.Send("pgbackup.put email")
 	if err != nil {
-		return nil, err
+		return err
 	}
 	cw := &chunkWriter{W: b.C}
 	_, err = cw.Write(([]byte)(config.Email))
 	if err != nil {
-		return nil, err
+		return backendErr(err)
+	}
+	return backendErr(cw.Close())
+}
+
+// connectDir serves the backend protocol from the files in the directory of
+// the storage, in this process over a socket pair
+func (b *Backend) connectDir() error {
+	fds, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_STREAM, 0)
+	if err != nil {
+		return err
+	}
+	var conns [2]net.Conn
+	for i, fd := range fds {
+		f := os.NewFile(uintptr(fd), "storage")
+		conns[i], err = net.FileConn(f)
+		f.Close()
+		if err != nil {
+			if i == 1 {
+				conns[0].Close()
+			}
+			return err
+		}
 	}
-	err = cw.Close()
+	go func() {
+		defer conns[1].Close()
+		err := serveFiles(conns[1], b.s.Dir, "")
+		if err != nil && err != io.EOF {
+			slog.Warn("storage", "dir", b.s.Dir, "err", err)
+		}
+	}()
+
+	b.C = conns[0]
+	b.rd = bufio.NewReaderSize(conns[0], 64*1024)
+	return nil
+}
+
+// backendTLSConfig verifies the backend of s against endpointCA (or the
+// system roots) and endpointPins, with AEAD suites only
+func backendTLSConfig(s *storage, endpoint string) (*tls.Config, error) {
+	host, _, err := net.SplitHostPort(endpoint)
 	if err != nil {
 		return nil, err
 	}
+	c := &tls.Config{
+		ServerName: host,
+		MinVersion: tls.VersionTLS12,
+		CipherSuites: []uint16{ // for 1.2, 1.3 has only AEAD suites
+			tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+			tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
+			tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305_SHA256,
+			tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+			tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
+			tls.TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305_SHA256,
+		},
+	}
+	switch s.TLSMinVersion {
+	case "", "1.2":
+	case "1.3":
+		c.MinVersion = tls.VersionTLS13
+	default:
+		return nil, fmt.Errorf("tlsMinVersion %s: use 1.2 or 1.3", s.TLSMinVersion)
+	}
 
-	return b, nil
+	if s.EndpointCA != "" {
+		pem, err := ioutil.ReadFile(s.EndpointCA)
+		if err != nil {
+			return nil, err
+		}
+		c.RootCAs = x509.NewCertPool()
+		if !c.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, errors.New("no certificates in " + s.EndpointCA)
+		}
+	}
+
+	if len(s.EndpointPins) > 0 {
+		// with only pins, like for a self signed server, they replace the
+		// verification against the system roots
+		verifyChain := s.EndpointCA != ""
+		c.InsecureSkipVerify = !verifyChain
+		c.VerifyConnection = func(cs tls.ConnectionState) error {
+			if verifyChain {
+				for _, chain := range cs.VerifiedChains {
+					for _, cert := range chain {
+						if pinned(s.EndpointPins, cert) {
+							return nil
+						}
+					}
+				}
+			} else if len(cs.PeerCertificates) > 0 {
+				// the other certificates are only what the server sent
+				// along, a pinned one must have signed the chain to the
+				// leaf, the key of which the handshake proved
+				leaf := cs.PeerCertificates[0]
+				if pinned(s.EndpointPins, leaf) {
+					return nil
+				}
+				roots, inter := x509.NewCertPool(), x509.NewCertPool()
+				for _, cert := range cs.PeerCertificates[1:] {
+					if pinned(s.EndpointPins, cert) {
+						roots.AddCert(cert)
+					} else {
+						inter.AddCert(cert)
+					}
+				}
+				_, err := leaf.Verify(x509.VerifyOptions{DNSName: host, Roots: roots, Intermediates: inter})
+				if err == nil {
+					return nil
+				}
+			}
+			if len(cs.PeerCertificates) > 0 {
+				return fmt.Errorf("%s: certificate doesn't match endpointPins, its pin is %s", endpoint, spkiPin(cs.PeerCertificates[0]))
+			}
+			return errors.New(endpoint + ": no certificate")
+		}
+	}
+	return c, nil
 }
 
-func (b Backend) Send(s string) error {
-	_, err := b.C.Write(([]byte)(s + "\n"))
+// pinned tells if cert has one of pins
+func pinned(pins []string, cert *x509.Certificate) bool {
+	for _, pin := range pins {
+		if spkiPin(cert) == pin {
+			return true
+		}
+	}
+	return false
+}
+
+// spkiPin is the base64 sha256 of the public key of cert, the same as
+// openssl x509 -pubkey -noout | openssl pkey -pubin -outform der | openssl dgst -sha256 -binary | base64
+func spkiPin(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// replyError is an error reply of the backend, eg "notFound", as opposed to
+// a broken connection
+type replyError string
+
+func (e replyError) Error() string {
+	return string(e)
+}
+
+// recover reconnects after a connection error err, unless that has failed
+// too often in a row. Only then, or for other errors, it returns an error.
+func (b *Backend) recover(err error) error {
+	var re replyError
+	if errors.As(err, &re) {
+		return err
+	}
+	for b.failures < backendRetries {
+		b.failures++
+		slog.Warn("backend connection failed, reconnecting", "err", err, "attempt", b.failures)
+		time.Sleep(time.Duration(b.failures-1) * time.Second)
+		b.C.Close()
+		err = b.connect()
+		if err == nil {
+			return nil
+		}
+	}
 	return err
 }
 
-func (b Backend) Request(s string) (string, error) {
+// retry runs op, which must be safe to repeat, again on a new connection
+// when the connection fails
+func (b *Backend) retry(op func() error) error {
+	for {
+		err := op()
+		if err == nil {
+			return nil
+		}
+		err = b.recover(err)
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func (b *Backend) Send(s string) error {
+	_, err := b.C.Write(([]byte)(s + "\n"))
+	return backendErr(err)
+}
+
+// reply reads a reply line
+func (b *Backend) reply() (string, error) {
+	l, err := b.rd.ReadString('\n')
+	if err != nil {
+		return "", backendErr(err)
+	}
+	b.failures = 0
+	return strings.TrimSuffix(l, "\n"), nil
+}
 
+func (b *Backend) Request(s string) (string, error) {
 	err := b.Send(s)
 	if err != nil {
 		return "", err
 	}
+	return b.reply()
+}
 
-	// read line byte-for-byte
-	var l []byte
-	for {
-		var buf [1]byte
-		_, err := b.C.Read(buf[:])
-		if err != nil {
-			return "", err
+// List returns the files with extension ext (eg "wal"), sorted
+func (b *Backend) List(ext string) ([]string, error) {
+	var rep string
+	err := b.retry(func() (err error) {
+		rep, err = b.Request("pgbackup.list " + ext)
+		return err
+	})
+	return strings.Fields(rep), err
+}
+
+// size reads the reply to a get, the file size in hex
+func (b *Backend) size() (int64, error) {
+	rep, err := b.reply()
+	if err != nil {
+		return 0, err
+	}
+	n, err := strconv.ParseInt(rep, 16, 64)
+	if err != nil || n < 0 {
+		return 0, replyError(rep) // eg: "notFound"
+	}
+	return n, nil
+}
+
+// Get requests file and returns a reader for its (still encrypted) contents,
+// which must be read completely before the next request. The reader picks up
+// where it was on a new connection if this one fails.
+func (b *Backend) Get(file string) (io.Reader, int64, error) {
+	g := &getReader{b: b, file: file}
+	err := b.retry(g.get)
+	if err != nil {
+		return nil, 0, err
+	}
+	return g, g.n, nil
+}
+
+type getReader struct {
+	b      *Backend
+	file   string
+	n, off int64 // size, read so far
+}
+
+// get (re)requests the file and skips what was read already
+func (g *getReader) get() error {
+	err := g.b.Send("pgbackup.get " + g.file)
+	if err != nil {
+		return err
+	}
+	n, err := g.b.size()
+	if err != nil {
+		return err
+	}
+	if g.off > 0 && n != g.n {
+		return fmt.Errorf("%s changed from %d to %d bytes while reading", g.file, g.n, n)
+	}
+	g.n = n
+	_, err = io.CopyN(ioutil.Discard, g.b.rd, g.off)
+	return backendErr(err)
+}
+
+func (g *getReader) Read(p []byte) (int, error) {
+	if g.off >= g.n {
+		return 0, io.EOF
+	}
+	if int64(len(p)) > g.n-g.off {
+		p = p[:g.n-g.off]
+	}
+	n, err := g.b.rd.Read(p)
+	g.off += int64(n)
+	if n > 0 || err == nil {
+		return n, nil
+	}
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	err = g.b.recover(backendErr(err))
+	if err == nil {
+		err = g.b.retry(g.get)
+	}
+	return 0, err
+}
+
+// GetAll gets (small) files with several requests in flight, and calls fn
+// with the (still encrypted) contents or the backend's error for each, in
+// order. It stops at the first error of fn.
+func (b *Backend) GetAll(files []string, fn func(file string, d []byte, err error) error) error {
+	var fnErr error
+	next := 0 // the first file not given to fn yet
+	err := b.retry(func() error {
+		sent := next
+		for next < len(files) && fnErr == nil {
+			for ; sent < len(files) && sent < next+getWindow; sent++ {
+				err := b.Send("pgbackup.get " + files[sent])
+				if err != nil {
+					return err
+				}
+			}
+
+			d, err := b.readFile()
+			var re replyError
+			if err != nil && !errors.As(err, &re) {
+				return err
+			}
+			fnErr = fn(files[next], d, err)
+			next++
 		}
-		if buf[0] == '\n' {
-			return string(l), nil
+
+		// rather than reading the replies still in flight
+		if next < sent {
+			b.C.Close()
+			return b.connect()
 		}
-		l = append(l, buf[0])
+		return nil
+	})
+	if fnErr != nil {
+		return fnErr
 	}
+	return err
+}
+
+// readFile reads the reply to a get
+func (b *Backend) readFile() ([]byte, error) {
+	n, err := b.size()
+	if err != nil {
+		return nil, err
+	}
+	d := make([]byte, n)
+	_, err = io.ReadFull(b.rd, d)
+	return d, backendErr(err)
+}
+
+// Delete removes file from storage
+func (b *Backend) Delete(file string) error {
+	rep, err := b.Request("pgbackup.delete " + file)
+	if err != nil {
+		return err
+	}
+	if rep != "ok" {
+		return replyError(rep) // eg: "notFound"
+	}
+	return nil
 }
 
-func (b Backend) Close() error {
+func (b *Backend) Close() error {
 	return b.C.Close()
 }
 
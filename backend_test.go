@@ -0,0 +1,344 @@
+package main
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testBackend is a backend from pgbackup serve in a temporary directory
+type testBackend struct {
+	dir string // of our account
+}
+
+// startBackend sets up a config and points Connect at a new testBackend
+func startBackend(t *testing.T) *testBackend {
+	t.Helper()
+	dir := t.TempDir()
+	t.Setenv("HOME", dir) // for upload state
+
+	config.SystemId = 6500000000000000001
+	config.Email = "test@example.com"
+	rand.Read(config.key[:])
+	aesBlock, _ = aes.NewCipher(config.key[:])
+
+	var b *testBackend
+	b, config.storage = serveTest(t, dir)
+	config.Storages = nil
+	return b
+}
+
+// serveTest runs a backend in dir, and returns the storage to reach it
+func serveTest(t *testing.T, dir string) (*testBackend, storage) {
+	t.Helper()
+	cert, err := serverCert(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tl, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	l := &testListener{Listener: tl}
+	go serveBackend(tls.NewListener(l, &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		ClientAuth:   tls.RequireAnyClientCert,
+	}), dir)
+	t.Cleanup(l.close)
+
+	key, err := clientKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	account, err := accountId(&key.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := &testBackend{dir: filepath.Join(dir, account)}
+	os.MkdirAll(b.dir, 0700)
+	return b, storage{Endpoint: l.Addr().String(), EndpointCA: filepath.Join(dir, "server.crt")}
+}
+
+// testListener keeps track of the connections of a testBackend, so the
+// test only removes its directory once the server is done with it
+type testListener struct {
+	net.Listener
+	conns sync.WaitGroup
+}
+
+type testConn struct {
+	net.Conn
+	done sync.Once
+	l    *testListener
+}
+
+func (l *testListener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	l.conns.Add(1)
+	return &testConn{Conn: c, l: l}, nil
+}
+
+func (c *testConn) Close() error {
+	c.done.Do(c.l.conns.Done)
+	return c.Conn.Close()
+}
+
+// close stops accepting and waits a bit for the open connections
+func (l *testListener) close() {
+	l.Close()
+	done := make(chan bool)
+	go func() {
+		l.conns.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+	}
+}
+
+func (b *testBackend) put(name string, d []byte) {
+	ioutil.WriteFile(filepath.Join(b.dir, name), d, 0600)
+}
+
+func (b *testBackend) file(name string) ([]byte, bool) {
+	d, err := ioutil.ReadFile(filepath.Join(b.dir, name))
+	return d, err == nil
+}
+
+// wait waits for the server to have stored file, puts are not acknowledged
+func (b *testBackend) wait(t *testing.T, name string) {
+	t.Helper()
+	for i := 0; i < 500; i++ {
+		if _, ok := b.file(name); ok {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("%s not stored", name)
+}
+
+// decrypted returns the plain contents of file
+func (b *testBackend) decrypted(t *testing.T, name string) []byte {
+	t.Helper()
+	d, ok := b.file(name)
+	if !ok {
+		t.Fatalf("%s not stored", name)
+	}
+	p := make([]byte, len(d))
+	aesStream(name).XORKeyStream(p, d)
+	return p
+}
+
+// putEncrypted stores plain as file, like the agent would
+func (b *testBackend) putEncrypted(name string, plain []byte) {
+	d := make([]byte, len(plain))
+	aesStream(name).XORKeyStream(d, plain)
+	b.put(name, d)
+}
+
+func TestGetAll(t *testing.T) {
+	b := startBackend(t)
+	var files []string
+	for i := 0; i < 40; i++ {
+		f := fmt.Sprintf("%016x.1.idx", i)
+		files = append(files, f)
+		if i%7 != 3 {
+			b.put(f, []byte(f))
+		}
+	}
+
+	backend, err := Connect()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer backend.Close()
+
+	var got []string
+	err = backend.GetAll(files, func(f string, d []byte, err error) error {
+		if i := len(got); f != files[i] {
+			t.Errorf("got %s, want %s", f, files[i])
+		}
+		got = append(got, f)
+		if (err != nil) != (len(got)%7 == 4) || err == nil && string(d) != f {
+			t.Errorf("%s: %q, %v", f, d, err)
+		}
+		return nil
+	})
+	if err != nil || len(got) != len(files) {
+		t.Fatalf("got %d files: %v", len(got), err)
+	}
+
+	// stopping early leaves the connection usable
+	stop := errors.New("stop")
+	err = backend.GetAll(files, func(f string, d []byte, err error) error {
+		return stop
+	})
+	if err != stop {
+		t.Fatalf("stop: %v", err)
+	}
+	rd, n, err := backend.Get(files[0])
+	if err != nil || n != int64(len(files[0])) {
+		t.Fatalf("get after stop: %v", err)
+	}
+	d, _ := ioutil.ReadAll(rd)
+	if string(d) != files[0] {
+		t.Fatalf("get after stop: %q", d)
+	}
+}
+
+func TestReconnect(t *testing.T) {
+	b := startBackend(t)
+	d := make([]byte, 1<<20)
+	rand.Read(d)
+	b.put("0000000000000001.base", d)
+
+	backend, err := Connect()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer backend.Close()
+
+	backend.C.Close()
+	files, err := backend.List("base")
+	if err != nil || len(files) != 1 {
+		t.Fatalf("list: %v, %v", files, err)
+	}
+
+	// the connection breaks halfway a get
+	rd, _, err := backend.Get(files[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	half := make([]byte, len(d)/2)
+	_, err = io.ReadFull(rd, half)
+	if err != nil {
+		t.Fatal(err)
+	}
+	backend.C.Close()
+	rest, err := ioutil.ReadAll(rd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(append(half, rest...), d) {
+		t.Fatal("resumed get has wrong contents")
+	}
+
+	_, _, err = backend.Get("0000000000000002.base")
+	if err == nil || err.Error() != "notFound" {
+		t.Fatalf("get missing: %v", err)
+	}
+}
+
+func TestFetchPrefetch(t *testing.T) {
+	b := startBackend(t)
+	segment := func(i int) []byte {
+		return bytes.Repeat([]byte{byte(i)}, segmentSize)
+	}
+	for i := 1; i <= 3; i++ {
+		b.putEncrypted(fmt.Sprintf("%016x.1.wal", i), segment(i))
+	}
+	b.putEncrypted("0000000000000004.1.wal", []byte{4}) // partial
+
+	dir := filepath.Join(t.TempDir(), "pg_wal")
+	os.Mkdir(dir, 0700)
+	target := filepath.Join(dir, "RECOVERYXLOG")
+	fetch := func(i int) {
+		t.Helper()
+		err := Fetch(fmt.Sprintf("00000001%08X%08X", 0, i), target)
+		if err != nil {
+			t.Fatalf("fetch %d: %v", i, err)
+		}
+		d, _ := ioutil.ReadFile(target)
+		want := segment(i)
+		if i == 4 {
+			want = make([]byte, segmentSize)
+			want[0] = 4
+		}
+		if !bytes.Equal(d, want) {
+			t.Fatalf("fetch %d: wrong contents", i)
+		}
+	}
+
+	fetch(1)
+	prefetched, _ := filepath.Glob(filepath.Join(dir, "pgbackup-prefetch", "*"))
+	if len(prefetched) != 2 {
+		t.Fatalf("prefetched %v, want segments 2 and 3", prefetched)
+	}
+
+	// without a backend
+	endpoint := config.Endpoint
+	config.Endpoint = "127.0.0.1:1"
+	fetch(2)
+	fetch(3)
+	config.Endpoint = endpoint
+	fetch(4)
+
+	err := Fetch("000000010000000000000005", target)
+	if err == nil {
+		t.Fatal("fetched a missing segment")
+	}
+	if _, err := os.Stat(filepath.Join(dir, "pgbackup-prefetch")); !os.IsNotExist(err) {
+		t.Fatal("prefetch dir left at the end of the archive")
+	}
+
+	// a short segment that isn't the latest is cut off, not being streamed
+	b.putEncrypted("0000000000000007.1.wal", []byte{7})
+	b.putEncrypted("0000000000000008.1.wal", segment(8))
+	os.Remove(target)
+	err = Fetch("000000010000000000000007", target)
+	if err == nil || !strings.Contains(err.Error(), "next one is in storage") {
+		t.Errorf("fetched a short segment followed by another: %v", err)
+	}
+	if _, err := os.Stat(target); !os.IsNotExist(err) {
+		t.Error("wrote the short segment")
+	}
+}
+
+func TestFetchChecksums(t *testing.T) {
+	b := startBackend(t)
+	wal := bytes.Repeat([]byte{1}, segmentSize)
+	file := walSegment{1, 1}.File()
+	b.putEncrypted(file, wal)
+	ix := &segmentIndex{}
+	ix.Size, ix.Sha256, ix.EncSha256 = sums(file, wal)
+	d, _ := json.Marshal(ix)
+	b.putEncrypted(indexFile(1, 1), d)
+
+	target := filepath.Join(t.TempDir(), "RECOVERYXLOG")
+	err := Fetch("000000010000000000000001", target)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// truncated, it isn't padded with zeros
+	stored, _ := b.file(file)
+	b.put(file, stored[:segmentSize/2])
+	err = Fetch("000000010000000000000001", target)
+	if err == nil || !strings.Contains(err.Error(), "bytes, expected") {
+		t.Errorf("truncated: %v", err)
+	}
+
+	stored[100] ^= 1
+	b.put(file, stored)
+	err = Fetch("000000010000000000000001", target)
+	if err == nil || !strings.Contains(err.Error(), "checksum mismatch") {
+		t.Errorf("corrupt: %v", err)
+	}
+}
@@ -0,0 +1,275 @@
+package main
+
+import (
+	"crypto/cipher"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log/slog"
+	"sort"
+	"strings"
+	"time"
+)
+
+// baseMeta is the sidecar object %016x.meta uploaded after every base
+// backup, so we can reason about backups without downloading them
+type baseMeta struct {
+	File              string           `json:"file"`
+	Label             string           `json:"label,omitempty"`
+	StartLsn          LSN              `json:"startLsn"`
+	EndLsn            LSN              `json:"endLsn,omitempty"`
+	Timeline          int              `json:"timeline,omitempty"`
+	EndTimeline       int              `json:"endTimeline,omitempty"`
+	ServerVersion     string           `json:"serverVersion,omitempty"`
+	Tablespaces       []baseTablespace `json:"tablespaces,omitempty"`
+	Size              int64            `json:"size"`
+	StartTime         time.Time        `json:"startTime"`
+	EndTime           time.Time        `json:"endTime"`
+	Wal               bool             `json:"wal,omitempty"`      // includes the wal from start to end
+	Manifest          string           `json:"manifest,omitempty"` // backup_manifest in storage
+	ManifestSize      int64            `json:"manifestSize,omitempty"`
+	ManifestSha256    string           `json:"manifestSha256,omitempty"`
+	ManifestEncSha256 string           `json:"manifestEncSha256,omitempty"`
+	Parent            string           `json:"parent,omitempty"` // base this is incremental to
+
+	legacy bool // no meta object, guessed from the name or backup_label
+}
+
+type baseTablespace struct {
+	Oid      string     `json:"oid,omitempty"` // empty for the data directory
+	Location string     `json:"location,omitempty"`
+	Size     int64      `json:"size,omitempty"`  // kB, estimated by the server
+	File     string     `json:"file,omitempty"`  // archive in storage
+	Parts    []basePart `json:"parts,omitempty"` // the archive is stored in these instead
+}
+
+func metaFile(base string) string {
+	return strings.TrimSuffix(base, ".base") + ".meta"
+}
+
+// tablespaceFile names the archive of tablespace oid of a base backup, the
+// data directory is stored as the base itself
+func tablespaceFile(base, oid string) string {
+	if oid == "" {
+		return base
+	}
+	return strings.TrimSuffix(base, ".base") + "." + oid + ".tblspc"
+}
+
+func manifestFile(base string) string {
+	return strings.TrimSuffix(base, ".base") + ".manifest"
+}
+
+// Consistent returns from where a restore of this base can be stopped
+func (m *baseMeta) Consistent() LSN {
+	if m.EndLsn != 0 {
+		return m.EndLsn
+	}
+	return m.StartLsn
+}
+
+// baseBackupQuery builds the BASE_BACKUP command for a server of major
+// version, which has a parenthesised option list since 15
+func baseBackupQuery(opts baseOptions, major int) (string, error) {
+	if opts.MaxRate != 0 && (opts.MaxRate < 32 || opts.MaxRate > 1048576) {
+		return "", errors.New("max rate must be between 32 and 1048576 kB/s")
+	}
+	if opts.Manifest && major < 13 {
+		return "", errors.New("backup manifests need postgres 13 or later")
+	}
+	if opts.Incremental && major < 17 {
+		return "", errors.New("incremental base backups need postgres 17 or later")
+	}
+	label := "'" + strings.Replace(opts.Label, "'", "''", -1) + "'"
+
+	if major >= 15 {
+		o := []string{"LABEL " + label, "WAIT false"}
+		if opts.Progress {
+			o = append(o, "PROGRESS") // the server estimates the size first
+		}
+		if opts.Fast {
+			o = append(o, "CHECKPOINT 'fast'")
+		}
+		if opts.Wal {
+			o = append(o, "WAL") // appended to the data directory archive, in pg_wal/
+		}
+		if opts.MaxRate != 0 {
+			o = append(o, fmt.Sprintf("MAX_RATE %d", opts.MaxRate))
+		}
+		if opts.Manifest {
+			o = append(o, "MANIFEST 'yes'", "MANIFEST_CHECKSUMS 'SHA256'")
+		}
+		if opts.Incremental {
+			o = append(o, "INCREMENTAL") // to the manifest uploaded before
+		}
+		return "BASE_BACKUP (" + strings.Join(o, ", ") + ")", nil
+	}
+
+	q := "BASE_BACKUP LABEL " + label + " NOWAIT"
+	if opts.Progress {
+		q += " PROGRESS"
+	}
+	if opts.Fast {
+		q += " FAST"
+	}
+	if opts.Wal {
+		q += " WAL"
+	}
+	if opts.MaxRate != 0 {
+		q += fmt.Sprintf(" MAX_RATE %d", opts.MaxRate)
+	}
+	if opts.Manifest {
+		q += " MANIFEST 'yes' MANIFEST_CHECKSUMS 'SHA256'"
+	}
+	return q, nil
+}
+
+// putObject encrypts and uploads a (small) object
+func putObject(backend *Backend, file string, d []byte) error {
+	err := backend.Send("pgbackup.put " + file)
+	if err != nil {
+		return err
+	}
+	cw := &chunkWriter{W: backend.C}
+	sw := &cipher.StreamWriter{W: cw, S: aesStream(file)}
+	_, err = sw.Write(d)
+	if err != nil {
+		return backendErr(err)
+	}
+	return backendErr(cw.Close())
+}
+
+// getObject downloads and decrypts a (small) object
+func getObject(backend *Backend, file string) ([]byte, error) {
+	rd, _, err := backend.Get(file)
+	if err != nil {
+		return nil, err
+	}
+	return ioutil.ReadAll(&cipher.StreamReader{R: rd, S: aesStream(file)})
+}
+
+// getManifest downloads and decrypts the backup_manifest of base, checking
+// its sums
+func getManifest(backend *Backend, base *baseMeta) ([]byte, error) {
+	rd, _, err := backend.Get(base.Manifest)
+	if err != nil {
+		return nil, err
+	}
+	d, err := ioutil.ReadAll(rd)
+	if err != nil {
+		return nil, err
+	}
+	err = checkSums(base.Manifest, d, base.ManifestSize, base.ManifestSha256, base.ManifestEncSha256)
+	if err != nil {
+		return nil, err
+	}
+	aesStream(base.Manifest).XORKeyStream(d, d)
+	return d, nil
+}
+
+// listBases returns all base backups in storage, in chronological order.
+// Backups from before meta objects existed are described from their name,
+// or from their backup_label when labels is set, which is slow.
+func listBases(backend *Backend, labels bool) ([]*baseMeta, error) {
+	files, err := backend.List("meta")
+	if err != nil {
+		return nil, err
+	}
+	metas := map[string]*baseMeta{}
+	err = backend.GetAll(files, func(f string, d []byte, err error) error {
+		if err != nil {
+			return fmt.Errorf("%s: %s", f, err)
+		}
+		aesStream(f).XORKeyStream(d, d)
+		var m baseMeta
+		if err := json.Unmarshal(d, &m); err != nil {
+			return fmt.Errorf("%s: %s", f, err)
+		}
+		metas[f] = &m
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// archives stored in parts have no .base object
+	var bases []*baseMeta
+	for _, m := range metas {
+		bases = append(bases, m)
+	}
+
+	files, err = backend.List("base")
+	if err != nil {
+		return nil, err
+	}
+	for _, f := range files {
+		var segment uint64
+		if n, _ := fmt.Sscanf(f, "%016x.base", &segment); n != 1 {
+			continue
+		}
+		if metas[metaFile(f)] != nil {
+			continue
+		}
+
+		m := &baseMeta{File: f, StartLsn: LSN(segment << 24), legacy: true}
+		if labels {
+			if l, err := baseBackupLabel(f); err == nil {
+				m.StartLsn, m.Timeline, m.StartTime, m.Label = l.Lsn, l.Timeline, l.Time, l.Label
+			}
+		}
+		bases = append(bases, m)
+	}
+	sort.Slice(bases, func(i, j int) bool {
+		return bases[i].StartLsn < bases[j].StartLsn
+	})
+	return bases, nil
+}
+
+// findBase picks a base backup by its file name, or the latest one that
+// started at or before an lsn. Bases imported without a manifest are only
+// picked by name, where they end is unknown.
+func findBase(bases []*baseMeta, id string) (*baseMeta, error) {
+	for _, m := range bases {
+		if m.File == id || m.File == id+".base" {
+			return m, nil
+		}
+	}
+	lsn, err := ParseLSN(id)
+	if err != nil {
+		return nil, fmt.Errorf("no base backup %s", id)
+	}
+	var base *baseMeta
+	for _, m := range bases {
+		if m.StartLsn <= lsn && (m.legacy || m.EndLsn != 0) {
+			base = m
+		}
+	}
+	if base == nil {
+		return nil, fmt.Errorf("no base backup at or before %s", lsn)
+	}
+	return base, nil
+}
+
+// incrementalParent picks the base for an incremental backup: the latest
+// one, if it has a manifest and its chain isn't too long already
+func incrementalParent(backend *Backend, maxChain int) (*baseMeta, error) {
+	bases, err := listBases(backend, false)
+	if err != nil {
+		return nil, err
+	}
+	if len(bases) == 0 || bases[len(bases)-1].Manifest == "" {
+		slog.Info("no base backup with a manifest to increment on, taking a full one")
+		return nil, nil
+	}
+	parent := bases[len(bases)-1]
+	chain, err := baseChain(bases, parent)
+	if err != nil {
+		return nil, err
+	}
+	if maxChain > 0 && len(chain) > maxChain {
+		slog.Info("incremental chain complete, taking a full base backup", "length", len(chain))
+		return nil, nil
+	}
+	return parent, nil
+}
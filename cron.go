@@ -0,0 +1,120 @@
+package main
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// cronSchedule is a parsed 5 field crontab expression (minute hour
+// day-of-month month day-of-week), each field a bitmask of allowed values
+type cronSchedule struct {
+	minute, hour, dom, month, dow uint64
+	domStar, dowStar              bool
+}
+
+var cronMacros = map[string]string{
+	"@hourly":  "0 * * * *",
+	"@daily":   "0 0 * * *",
+	"@weekly":  "0 0 * * 0",
+	"@monthly": "0 0 1 * *",
+}
+
+func parseCron(s string) (*cronSchedule, error) {
+	if m, ok := cronMacros[s]; ok {
+		s = m
+	}
+	f := strings.Fields(s)
+	if len(f) != 5 {
+		return nil, errors.New("invalid cron expression: " + s)
+	}
+
+	var c cronSchedule
+	var err error
+	if c.minute, err = parseCronField(f[0], 0, 59); err != nil {
+		return nil, err
+	}
+	if c.hour, err = parseCronField(f[1], 0, 23); err != nil {
+		return nil, err
+	}
+	if c.dom, err = parseCronField(f[2], 1, 31); err != nil {
+		return nil, err
+	}
+	if c.month, err = parseCronField(f[3], 1, 12); err != nil {
+		return nil, err
+	}
+	if c.dow, err = parseCronField(f[4], 0, 7); err != nil {
+		return nil, err
+	}
+	if c.dow&(1<<7) != 0 { // 7 is sunday as well
+		c.dow |= 1
+	}
+	// like "*", "*/1" or "1-31" leave a day field unrestricted
+	c.domStar = c.dom == 1<<32-2
+	c.dowStar = c.dow&0x7f == 0x7f
+	return &c, nil
+}
+
+// parses eg "*", "*/15", "1-5", "0,30" or "8-18/2"
+func parseCronField(s string, min, max int) (uint64, error) {
+	var mask uint64
+	for _, part := range strings.Split(s, ",") {
+		lo, hi, step := min, max, 1
+		rng := part
+		if i := strings.IndexByte(part, '/'); i >= 0 {
+			n, err := strconv.Atoi(part[i+1:])
+			if err != nil || n <= 0 {
+				return 0, errors.New("invalid cron step: " + part)
+			}
+			step = n
+			rng = part[:i]
+		}
+		if rng != "*" {
+			ab := strings.SplitN(rng, "-", 2)
+			a, err := strconv.Atoi(ab[0])
+			if err != nil {
+				return 0, errors.New("invalid cron field: " + part)
+			}
+			lo, hi = a, a
+			if len(ab) == 2 {
+				if hi, err = strconv.Atoi(ab[1]); err != nil {
+					return 0, errors.New("invalid cron field: " + part)
+				}
+			} else if step > 1 {
+				hi = max // "5/10" means from 5 on
+			}
+		}
+		if lo < min || hi > max || lo > hi {
+			return 0, errors.New("cron field out of range: " + part)
+		}
+		for i := lo; i <= hi; i += step {
+			mask |= 1 << uint(i)
+		}
+	}
+	return mask, nil
+}
+
+func (c *cronSchedule) match(t time.Time) bool {
+	if c.minute&(1<<uint(t.Minute())) == 0 || c.hour&(1<<uint(t.Hour())) == 0 || c.month&(1<<uint(t.Month())) == 0 {
+		return false
+	}
+	dom := c.dom&(1<<uint(t.Day())) != 0
+	dow := c.dow&(1<<uint(t.Weekday())) != 0
+	if c.domStar || c.dowStar {
+		return dom && dow
+	}
+	return dom || dow // like cron: either day field matches if both are restricted
+}
+
+// Next returns the first matching minute after t
+func (c *cronSchedule) Next(t time.Time) time.Time {
+	t = t.Truncate(time.Minute).Add(time.Minute)
+	for i := 0; i < 366*24*60; i++ {
+		if c.match(t) {
+			return t
+		}
+		t = t.Add(time.Minute)
+	}
+	return time.Time{} // eg "0 0 31 2 *"
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCronNext(t *testing.T) {
+	at := func(s string) time.Time {
+		v, err := time.Parse("2006-01-02 15:04", s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return v
+	}
+	// 2024-01-01 is a monday
+	for _, c := range []struct{ spec, from, next string }{
+		{"0 5,13,21 * * *", "2024-01-01 00:00", "2024-01-01 05:00"},
+		{"0 5,13,21 * * *", "2024-01-01 05:00", "2024-01-01 13:00"},
+		{"0 5,13,21 * * *", "2024-01-01 21:30", "2024-01-02 05:00"},
+		{"*/15 * * * *", "2024-01-01 00:00", "2024-01-01 00:15"},
+		{"5/10 * * * *", "2024-01-01 00:06", "2024-01-01 00:15"},
+		{"30 8-18/2 * * *", "2024-01-01 09:00", "2024-01-01 10:30"},
+		{"30 8-18/2 * * *", "2024-01-01 19:00", "2024-01-02 08:30"},
+		{"0 0 * * 1-5", "2024-01-05 12:00", "2024-01-08 00:00"},
+		{"0 0 * * 0", "2024-01-01 00:00", "2024-01-07 00:00"},
+		{"0 0 * * 7", "2024-01-01 00:00", "2024-01-07 00:00"},
+		{"0 0 13 * *", "2024-01-01 00:00", "2024-01-13 00:00"},
+		{"0 0 13 * 5", "2024-01-01 00:00", "2024-01-05 00:00"}, // either day field
+		{"0 0 13 * 5", "2024-01-12 01:00", "2024-01-13 00:00"},
+		{"0 0 1-31 * 5", "2024-01-01 00:00", "2024-01-05 00:00"}, // unrestricted days
+		{"0 0 */1 * 5", "2024-01-05 01:00", "2024-01-12 00:00"},
+		{"0 0 13 * */1", "2024-01-01 00:00", "2024-01-13 00:00"},
+		{"0 0 13 * 0-7", "2024-01-01 00:00", "2024-01-13 00:00"},
+		{"0 0 */2 * 5", "2024-01-01 00:00", "2024-01-03 00:00"}, // restricted by a step
+		{"0 0 */2 * 5", "2024-01-04 00:00", "2024-01-05 00:00"},
+		{"0 0 1 */3 *", "2024-01-02 00:00", "2024-04-01 00:00"},
+		{"0 0 29 2 *", "2024-03-01 00:00", ""}, // not within a year
+		{"0 0 31 2 *", "2024-01-01 00:00", ""},
+		{"@weekly", "2024-01-01 00:00", "2024-01-07 00:00"},
+		{"@monthly", "2024-01-01 00:00", "2024-02-01 00:00"},
+	} {
+		s, err := parseCron(c.spec)
+		if err != nil {
+			t.Errorf("%s: %s", c.spec, err)
+			continue
+		}
+		next := s.Next(at(c.from))
+		if c.next == "" && !next.IsZero() || c.next != "" && !next.Equal(at(c.next)) {
+			t.Errorf("%s from %s: %s, want %s", c.spec, c.from, next, c.next)
+		}
+	}
+}
+
+func TestCronInvalid(t *testing.T) {
+	for _, spec := range []string{"", "* * * *", "* * * * * *", "60 * * * *", "* 24 * * *", "0 0 0 * *", "0 0 * 13 *", "0 0 * * 8", "5-1 * * * *", "*/0 * * * *", "a * * * *", "1-a * * * *", "@yearly"} {
+		if _, err := parseCron(spec); err == nil {
+			t.Errorf("%q parsed", spec)
+		}
+	}
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+const defaultBaseCron = "0 5,13,21 * * *"
+
+// progress shared between the stream and base backup goroutines of the daemon
+var (
+	streamLsn uint64 // start of the segment currently being streamed
+	baseLsn   uint64 // start of the latest base backup
+)
+
+func Daemon() error {
+	unlock, err := lockSystem()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	var sched *cronSchedule
+	if config.BaseCron != "" || config.BaseWalGB == 0 {
+		spec := config.BaseCron
+		if spec == "" {
+			spec = defaultBaseCron
+		}
+		sched, err = parseCron(spec)
+		if err != nil {
+			return err
+		}
+		if sched.Next(time.Now()).IsZero() {
+			return errors.New("baseCron never matches: " + spec)
+		}
+	}
+
+	if config.MirrorTo != "" {
+		to, err := findStorage(config.MirrorTo)
+		if err != nil {
+			return err
+		}
+		if to == &config.storage {
+			return errors.New("mirrorTo is the main storage")
+		}
+	}
+	if config.MirrorMinutes < 0 || config.BaseIncremental < 0 || config.BaseWalGB < 0 {
+		return errors.New("mirrorMinutes, baseIncremental and baseWalGB can't be negative")
+	}
+
+	lsn, err := latestBase()
+	if err != nil {
+		return err
+	}
+	atomic.StoreUint64(&baseLsn, uint64(lsn))
+	slog.Info("daemon started", "baseLsn", lsn)
+
+	go streamForever()
+	if config.MirrorTo != "" {
+		go mirrorForever()
+	}
+
+	var next, retry time.Time
+	if sched != nil {
+		next = sched.Next(time.Now())
+		slog.Info("next base backup", "at", next)
+	}
+
+	for now := range time.Tick(10 * time.Second) {
+		due := sched != nil && !now.Before(next)
+		if config.BaseWalGB > 0 && now.After(retry) {
+			s, b := atomic.LoadUint64(&streamLsn), atomic.LoadUint64(&baseLsn)
+			if s > b && s-b >= uint64(config.BaseWalGB)<<30 {
+				slog.Info("base backup due", "walBytes", s-b)
+				due = true
+			}
+		}
+		if !due {
+			continue
+		}
+
+		err := Basebackup(baseOptions{
+			Manifest:    config.BaseIncremental > 0,
+			Incremental: config.BaseIncremental > 0,
+			MaxChain:    config.BaseIncremental,
+			Fallback:    true, // baseIncremental is no reason to stop backing up an older server
+			Resume:      true, // after a failed one
+		})
+		if err != nil {
+			slog.Error("base backup failed", "err", err)
+			retry = time.Now().Add(15 * time.Minute)
+		}
+		if sched != nil {
+			next = sched.Next(time.Now())
+			slog.Info("next base backup", "at", next)
+		}
+	}
+	return nil
+}
+
+// streamForever keeps Stream running, backing off a bit more after every
+// failure
+func streamForever() {
+	var restartN int
+	for {
+		err := Stream()
+		restartN++
+		atomic.AddUint64(&metrics.restarts, 1)
+		sleep := restartN * restartN
+		if sleep > 100 {
+			sleep = 100
+		}
+		slog.Warn("stream stopped", "err", err, "restarts", restartN, "retryIn", time.Duration(sleep)*time.Second)
+		time.Sleep(time.Duration(sleep) * time.Second)
+	}
+}
+
+// latestBase returns the start lsn of the most recent base backup in storage
+func latestBase() (LSN, error) {
+	backend, err := Connect()
+	if err != nil {
+		return 0, err
+	}
+	defer backend.Close()
+
+	bases, err := listBases(backend, false)
+	if err != nil {
+		return 0, err
+	}
+	if len(bases) == 0 {
+		return 0, nil
+	}
+	return bases[len(bases)-1].StartLsn, nil
+}
+
+// lockSystem takes an exclusive lock for our systemId, so only one process
+// streams to the backend at a time
+func lockSystem() (func(), error) {
+	name := fmt.Sprintf("%s/.pgbackup-%d.lock", os.Getenv("HOME"), config.SystemId)
+	f, err := os.OpenFile(name, os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		return nil, err
+	}
+	err = syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("another pgbackup is already streaming system %d (%s)", config.SystemId, name)
+	}
+	return func() { f.Close() }, nil
+}
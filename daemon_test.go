@@ -0,0 +1,22 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestDaemonConfig(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+	startBackend(t)
+	config.Endpoint = "127.0.0.1:1" // fails if the daemon gets as far as connecting
+	for mirrorTo, want := range map[string]string{
+		"nowhere": "no storage nowhere in ~/pgbackup.conf",
+		"default": "mirrorTo is the main storage",
+	} {
+		config.MirrorTo = mirrorTo
+		err := Daemon()
+		if err == nil || err.Error() != want {
+			t.Errorf("mirrorTo %s: %v", mirrorTo, err)
+		}
+	}
+	config.MirrorTo = ""
+}
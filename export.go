@@ -0,0 +1,320 @@
+package main
+
+// writes backups out of storage in the formats of the stock tools, like
+// pg_basebackup -Ft and a wal archive
+
+import (
+	"archive/tar"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log/slog"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// ExportBase writes base backup id (a file name or lsn) like pg_basebackup
+// -Ft does: the data directory to file, and next to it an <oid>.tar per
+// tablespace and the backup_manifest. With a .zst extension, the archives
+// are compressed with zstd. Incremental backups are combined with their
+// parents first, without a manifest.
+func ExportBase(id, file string) error {
+	backend, err := Connect()
+	if err != nil {
+		return err
+	}
+	defer backend.Close()
+
+	bases, err := listBases(backend, false)
+	if err != nil {
+		return err
+	}
+	base, err := findBase(bases, id)
+	if err != nil {
+		return err
+	}
+	chain, err := baseChain(bases, base)
+	if err != nil {
+		return err
+	}
+
+	tablespaces := base.Tablespaces
+	if len(tablespaces) == 0 {
+		tablespaces = []baseTablespace{{}} // legacy, only the data directory
+	}
+	ext := ".tar"
+	if strings.HasSuffix(file, ".zst") {
+		ext = ".tar.zst"
+	}
+	dir := filepath.Dir(file)
+	if file == "-" && len(tablespaces) > 1 {
+		return errors.New("base backup has tablespaces, export it to a file")
+	}
+
+	for _, ts := range tablespaces {
+		out := file
+		if ts.Oid != "" {
+			out = filepath.Join(dir, ts.Oid+ext)
+		}
+		slog.Info("export archive", "base", base.File, "tablespace", ts.Oid, "file", out)
+
+		w, err := createArchive(out)
+		if err != nil {
+			return err
+		}
+		if len(chain) == 1 {
+			err = exportArchive(backend, base, archiveFile(base, ts.Oid), w)
+		} else {
+			err = exportCombined(backend, chain, ts.Oid, w, dir)
+		}
+		if err == nil {
+			err = w.Close()
+		} else {
+			w.Close()
+		}
+		if err != nil {
+			return fmt.Errorf("%s: %s", out, err)
+		}
+	}
+
+	if base.Manifest != "" && len(chain) == 1 && file != "-" {
+		d, err := getManifest(backend, base)
+		if err != nil {
+			return err
+		}
+		err = ioutil.WriteFile(filepath.Join(dir, "backup_manifest"), d, 0600)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// exportArchive copies an archive of base to w. The server doesn't end its
+// archives with the two zero blocks of a tar file, pg_basebackup adds them,
+// imported ones have them, so it goes through a tar writer.
+func exportArchive(backend *Backend, base *baseMeta, file string, w io.Writer) error {
+	rd, err := openArchive(backend, base, file)
+	if err != nil {
+		return err
+	}
+	tw := tar.NewWriter(w)
+	_, err = copyTar(tw, rd, "")
+	if err != nil {
+		return err
+	}
+	return tw.Close()
+}
+
+// copyTar copies the entries of a tar archive from r to tw, the names
+// prefixed with prefix
+func copyTar(tw *tar.Writer, r io.Reader, prefix string) (int, error) {
+	var n int
+	tr := tar.NewReader(r)
+	for {
+		h, err := tr.Next()
+		if err == io.EOF {
+			return n, nil
+		}
+		if err != nil {
+			return n, err
+		}
+		h.Name = prefix + h.Name
+		err = tw.WriteHeader(h)
+		if err == nil {
+			_, err = io.Copy(tw, tr)
+		}
+		if err != nil {
+			return n, err
+		}
+		n++
+	}
+}
+
+// exportCombined combines an archive (tablespace oid) of an incremental
+// chain in a temporary directory next to the output, and writes it to w
+func exportCombined(backend *Backend, chain []*baseMeta, oid string, w io.Writer, dir string) error {
+	tmp, err := ioutil.TempDir(dir, ".pgbackup-export-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmp)
+	out := filepath.Join(tmp, "combined")
+	err = os.Mkdir(out, 0700)
+	if err != nil {
+		return err
+	}
+	err = extractChain(backend, chain, oid, out)
+	if err != nil {
+		return err
+	}
+	return writeTar(w, out)
+}
+
+// writeTar writes the contents of dir to w as a tar archive, with the names
+// relative to dir like postgres does
+func writeTar(w io.Writer, dir string) error {
+	tw := tar.NewWriter(w)
+	err := filepath.Walk(dir, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil || rel == "." {
+			return err
+		}
+		var link string
+		if fi.Mode()&os.ModeSymlink != 0 {
+			link, err = os.Readlink(path)
+			if err != nil {
+				return err
+			}
+		}
+		h, err := tar.FileInfoHeader(fi, link)
+		if err != nil {
+			return err
+		}
+		h.Name = filepath.ToSlash(rel)
+		if fi.IsDir() {
+			h.Name += "/"
+		}
+		err = tw.WriteHeader(h)
+		if err != nil || !fi.Mode().IsRegular() {
+			return err
+		}
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		_, err = io.Copy(tw, f)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	return tw.Close()
+}
+
+// archiveWriter writes an archive file, compressed if its name ends in .zst
+type archiveWriter struct {
+	f    *os.File
+	w    io.WriteCloser // to f, or zstd
+	zstd *exec.Cmd
+}
+
+func createArchive(file string) (*archiveWriter, error) {
+	a := &archiveWriter{f: os.Stdout}
+	if file != "-" {
+		f, err := os.Create(file)
+		if err != nil {
+			return nil, err
+		}
+		a.f = f
+	}
+	a.w = a.f
+	if strings.HasSuffix(file, ".zst") {
+		a.zstd = exec.Command("zstd", "-q", "-c")
+		a.zstd.Stdout = a.f
+		a.zstd.Stderr = os.Stderr
+		w, err := a.zstd.StdinPipe()
+		if err == nil {
+			err = a.zstd.Start()
+		}
+		if err != nil {
+			a.f.Close()
+			return nil, fmt.Errorf("zstd: %s", err)
+		}
+		a.w = w
+	}
+	return a, nil
+}
+
+func (a *archiveWriter) Write(p []byte) (int, error) {
+	return a.w.Write(p)
+}
+
+func (a *archiveWriter) Close() error {
+	var err error
+	if a.zstd != nil {
+		err = a.w.Close()
+		if werr := a.zstd.Wait(); err == nil && werr != nil {
+			err = fmt.Errorf("zstd: %s", werr)
+		}
+	}
+	if a.f != os.Stdout {
+		if cerr := a.f.Close(); err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
+
+// ExportWal writes the wal segments from lsn from up to to into dir, named
+// like postgres does, eg for pg_waldump or as the archive of a standby
+func ExportWal(from, to, dir string) error {
+	lsn0, err := ParseLSN(from)
+	if err != nil {
+		return err
+	}
+	lsn1, err := ParseLSN(to)
+	if err != nil {
+		return err
+	}
+	if lsn1 <= lsn0 {
+		return errors.New("nothing to export, to must be after from")
+	}
+
+	backend, err := Connect()
+	if err != nil {
+		return err
+	}
+	defer backend.Close()
+
+	files, err := backend.List("wal")
+	if err != nil {
+		return err
+	}
+	var segs []walSegment
+	next := lsn0 &^ (segmentSize - 1)
+	for _, s := range segmentTimelines(parseWalList(files)) {
+		if s.Lsn()+segmentSize <= lsn0 {
+			continue
+		}
+		if s.Lsn() >= lsn1 {
+			break
+		}
+		if s.Lsn() != next {
+			return fmt.Errorf("missing wal %s - %s", next, s.Lsn())
+		}
+		segs = append(segs, s)
+		next += segmentSize
+	}
+	if next < lsn1 {
+		return fmt.Errorf("wal ends at %s", next)
+	}
+
+	err = os.MkdirAll(dir, 0700)
+	if err != nil {
+		return err
+	}
+	return getSegments(backend, segs, func(s walSegment, d []byte, checked bool, err error) error {
+		name := segmentName(s.Timeline, s.Lsn())
+		if err != nil {
+			return fmt.Errorf("%s: %s", name, err)
+		}
+		if len(d) < segmentSize {
+			slog.Warn("partial segment, filled up with zeros", "segment", name, "bytes", len(d))
+			d = append(d, make([]byte, segmentSize-len(d))...)
+		}
+		err = ioutil.WriteFile(filepath.Join(dir, name), d, 0600)
+		if err != nil {
+			return err
+		}
+		slog.Info("exported", "segment", name, "timeline", s.Timeline, "checked", checked)
+		return nil
+	})
+}
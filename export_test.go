@@ -0,0 +1,136 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"./pg/pgtest"
+)
+
+func TestExportBase(t *testing.T) {
+	startBackend(t)
+	// the server's archives end without the two zero blocks, and the
+	// last file is pg_control, which ends in zeros
+	control := make([]byte, 8192)
+	copy(control, "pg_control")
+	base := testTar(t, map[string]string{"global/pg_control": string(control)})
+	s := startPg(t, &pgtest.Server{
+		Version:     "16.4",
+		BackupStart: 0x5000028,
+		BackupEnd:   0x5000138,
+		Tablespaces: []pgtest.Tablespace{
+			{Oid: "16400", Location: "/srv/ts", Tar: testTar(t, map[string]string{"PG_16_202307071/5/16401": "rows"})},
+			{Tar: base[:len(base)-1024]},
+		},
+		Manifest: []byte(`{"PostgreSQL-Backup-Manifest-Version": 1}` + "\n"),
+	})
+	err := Basebackup(baseOptions{Manifest: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir := t.TempDir()
+	err = ExportBase("0/5000028", filepath.Join(dir, "base.tar"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d, _ := ioutil.ReadFile(filepath.Join(dir, "base.tar")); !bytes.Equal(d, base) {
+		t.Errorf("base.tar: %d bytes, want %d", len(d), len(base))
+	}
+	for file, want := range map[string]string{"base.tar": string(control), "16400.tar": "rows"} {
+		d, err := ioutil.ReadFile(filepath.Join(dir, file))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.HasSuffix(d, make([]byte, 1024)) || len(d)%512 != 0 {
+			t.Errorf("%s: no tar trailer", file)
+		}
+		tr := tar.NewReader(bytes.NewReader(d))
+		var found bool
+		for {
+			h, err := tr.Next()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				t.Fatalf("%s: %s", file, err)
+			}
+			c, _ := ioutil.ReadAll(tr)
+			found = found || string(c) == want && h.Typeflag == tar.TypeReg
+		}
+		if !found {
+			t.Errorf("%s: %s missing", file, want)
+		}
+	}
+	if d, _ := ioutil.ReadFile(filepath.Join(dir, "backup_manifest")); !bytes.Equal(d, s.Manifest) {
+		t.Error("manifest differs")
+	}
+}
+
+func TestWriteTar(t *testing.T) {
+	dir := t.TempDir()
+	os.MkdirAll(filepath.Join(dir, "base/5"), 0700)
+	ioutil.WriteFile(filepath.Join(dir, "base/5/1259"), []byte("pg_class"), 0600)
+	os.MkdirAll(filepath.Join(dir, "pg_tblspc"), 0700)
+	os.Symlink("/srv/ts", filepath.Join(dir, "pg_tblspc/16400"))
+
+	var buf bytes.Buffer
+	err := writeTar(&buf, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	tr := tar.NewReader(&buf)
+	for {
+		h, err := tr.Next()
+		if err != nil {
+			break
+		}
+		got = append(got, fmt.Sprintf("%s %c %s", h.Name, h.Typeflag, h.Linkname))
+	}
+	want := "base/ 5 ,base/5/ 5 ,base/5/1259 0 ,pg_tblspc/ 5 ,pg_tblspc/16400 2 /srv/ts"
+	if strings.Join(got, ",") != want {
+		t.Errorf("tar has %q", got)
+	}
+}
+
+func TestExportWal(t *testing.T) {
+	b := startBackend(t)
+	segment := func(i int) []byte { return bytes.Repeat([]byte{byte(i)}, segmentSize) }
+	for i := 1; i <= 3; i++ {
+		b.putEncrypted(walSegment{uint64(i), 1}.File(), segment(i))
+	}
+	b.putEncrypted(walSegment{4, 1}.File(), []byte{4}) // the tip, still streaming
+
+	dir := t.TempDir()
+	err := ExportWal("0/1000010", "0/4000010", dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 1; i <= 4; i++ {
+		d, err := ioutil.ReadFile(filepath.Join(dir, segmentName(1, LSN(i)<<24)))
+		if err != nil || len(d) != segmentSize || d[0] != byte(i) {
+			t.Errorf("segment %d: %d bytes, %v", i, len(d), err)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(dir, segmentName(1, 0))); !os.IsNotExist(err) {
+		t.Error("exported a segment before the range")
+	}
+
+	err = ExportWal("0/1000000", "0/6000000", t.TempDir())
+	if err == nil || err.Error() != "wal ends at 0/05000000" {
+		t.Errorf("past the end: %v", err)
+	}
+	os.Remove(filepath.Join(b.dir, walSegment{2, 1}.File()))
+	err = ExportWal("0/1000000", "0/4000000", t.TempDir())
+	if err == nil || !strings.Contains(err.Error(), "missing wal") {
+		t.Errorf("gap: %v", err)
+	}
+}
@@ -0,0 +1,585 @@
+package main
+
+// imports backups taken with the stock tools, pg_basebackup -Ft and an
+// archive_command copying wal, so their recovery points are in storage too
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log/slog"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"./wal"
+)
+
+// archiveExts are the compressions pg_basebackup and archive_commands
+// commonly use, in the order we look for them
+var archiveExts = []string{"", ".gz", ".zst"}
+
+// openCompressed opens file, decompressing it according to its extension
+func openCompressed(file string) (io.ReadCloser, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case strings.HasSuffix(file, ".gz"):
+		zr, err := gzip.NewReader(f)
+		if err != nil {
+			f.Close()
+			return nil, fmt.Errorf("%s: %s", file, err)
+		}
+		return &readCloser{zr, func() error { zr.Close(); return f.Close() }}, nil
+	case strings.HasSuffix(file, ".zst"):
+		cmd := exec.Command("zstd", "-q", "-d", "-c")
+		cmd.Stdin = f
+		cmd.Stderr = os.Stderr
+		out, err := cmd.StdoutPipe()
+		if err == nil {
+			err = cmd.Start()
+		}
+		if err != nil {
+			f.Close()
+			return nil, fmt.Errorf("zstd: %s", err)
+		}
+		return &readCloser{out, func() error {
+			io.Copy(ioutil.Discard, out)
+			err := cmd.Wait()
+			f.Close()
+			if err != nil {
+				return fmt.Errorf("zstd: %s: %s", file, err)
+			}
+			return nil
+		}}, nil
+	}
+	return f, nil
+}
+
+type readCloser struct {
+	io.Reader
+	close func() error
+}
+
+func (r *readCloser) Close() error {
+	return r.close()
+}
+
+// findArchive returns the path of archive name (eg base.tar) in dir, in
+// any of archiveExts, or "" if there is none
+func findArchive(dir, name string) string {
+	for _, ext := range archiveExts {
+		if _, err := os.Stat(filepath.Join(dir, name+ext)); err == nil {
+			return filepath.Join(dir, name+ext)
+		}
+	}
+	return ""
+}
+
+// pgBasebackup is what we learn from the data directory archive of a
+// pg_basebackup -Ft before uploading it
+type pgBasebackup struct {
+	label       *baseLabel
+	systemId    uint64            // from global/pg_control
+	version     string            // PG_VERSION
+	locations   map[string]string // of the tablespaces, by oid
+	walSegments int               // in pg_wal/
+}
+
+func scanBasebackup(file string) (*pgBasebackup, error) {
+	f, err := openCompressed(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	b := &pgBasebackup{locations: map[string]string{}}
+	tr := tar.NewReader(f)
+	for {
+		h, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", file, err)
+		}
+		name := strings.TrimPrefix(h.Name, "./")
+		switch {
+		case name == "backup_label":
+			b.label, err = parseBackupLabel(tr)
+		case name == "global/pg_control":
+			var d [8]byte
+			_, err = io.ReadFull(tr, d[:])
+			b.systemId = binary.LittleEndian.Uint64(d[:]) // ControlFileData.system_identifier
+		case name == "PG_VERSION":
+			var d []byte
+			d, err = ioutil.ReadAll(tr)
+			b.version = strings.TrimSpace(string(d))
+		case name == "tablespace_map":
+			var d []byte
+			d, err = ioutil.ReadAll(tr)
+			for _, l := range strings.Split(string(d), "\n") {
+				if kv := strings.SplitN(l, " ", 2); len(kv) == 2 {
+					b.locations[kv[0]] = kv[1]
+				}
+			}
+		case strings.HasPrefix(name, "pg_tblspc/") && h.Typeflag == tar.TypeSymlink:
+			b.locations[strings.TrimPrefix(name, "pg_tblspc/")] = h.Linkname
+		case strings.HasPrefix(name, "pg_wal/") && isSegmentName(strings.TrimPrefix(name, "pg_wal/")):
+			b.walSegments++
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s: %s", file, name, err)
+		}
+	}
+	if b.label == nil {
+		return nil, fmt.Errorf("%s: no backup_label, not a base backup", file)
+	}
+	if b.systemId == 0 {
+		return nil, fmt.Errorf("%s: no global/pg_control", file)
+	}
+	return b, nil
+}
+
+// ImportBase uploads the pg_basebackup -Ft output in dir: base.tar, an
+// <oid>.tar per tablespace and, if there, pg_wal.tar and backup_manifest.
+// The archives can be compressed with gzip or zstd. An import interrupted
+// before it wrote the meta is resumed.
+func ImportBase(dir string) error {
+	baseTar := findArchive(dir, "base.tar")
+	if baseTar == "" {
+		return fmt.Errorf("%s: no base.tar", dir)
+	}
+	b, err := scanBasebackup(baseTar)
+	if err != nil {
+		return err
+	}
+	if b.systemId != config.SystemId {
+		return fmt.Errorf("%s is of system %d, expected %d", baseTar, b.systemId, config.SystemId)
+	}
+
+	meta := baseMeta{
+		File:          fmt.Sprintf("%016x.base", uint64(b.label.Lsn)>>24),
+		Label:         b.label.Label,
+		StartLsn:      b.label.Lsn,
+		Timeline:      b.label.Timeline,
+		ServerVersion: b.version,
+		StartTime:     b.label.Time,
+		// EndTime stays unknown, restore goes by EndLsn
+	}
+
+	manifest, err := ioutil.ReadFile(filepath.Join(dir, "backup_manifest"))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if manifest != nil {
+		var m backupManifest
+		if err := json.Unmarshal(manifest, &m); err != nil {
+			return fmt.Errorf("backup_manifest: %s", err)
+		}
+		if m.SystemId != 0 && m.SystemId != config.SystemId {
+			return fmt.Errorf("backup_manifest is of system %d, expected %d", m.SystemId, config.SystemId)
+		}
+		if len(m.WalRanges) > 0 {
+			r := m.WalRanges[len(m.WalRanges)-1]
+			meta.EndLsn, meta.EndTimeline = r.End, r.Timeline
+		}
+		meta.Manifest = manifestFile(meta.File)
+	} else {
+		slog.Warn("no backup_manifest, the end of the backup is unknown and restore won't use it", "dir", dir)
+	}
+
+	var tablespaces []string
+	for oid := range b.locations {
+		if findArchive(dir, oid+".tar") == "" {
+			return fmt.Errorf("%s: tablespace %s has no %s.tar", dir, oid, oid)
+		}
+		tablespaces = append(tablespaces, oid)
+	}
+	sort.Strings(tablespaces)
+	walTar := findArchive(dir, "pg_wal.tar")
+
+	backend, err := Connect()
+	if err != nil {
+		return err
+	}
+	defer backend.Close()
+
+	bases, err := listBases(backend, false)
+	if err != nil {
+		return err
+	}
+	for _, m := range bases {
+		if m.File == meta.File {
+			return fmt.Errorf("%s: a base backup starting in that segment is in storage already, %s", dir, m.File)
+		}
+	}
+	label := "import " + meta.File
+	state, err := resumeUpload(backend, baseOptions{Label: label, Resume: true}, meta.File)
+	if err != nil {
+		return err
+	}
+
+	// tablespaces first, like the server sends them
+	for _, oid := range append(tablespaces, "") {
+		ts := baseTablespace{Oid: oid, Location: b.locations[oid], File: tablespaceFile(meta.File, oid)}
+		src := baseTar
+		if oid != "" {
+			src = findArchive(dir, oid+".tar")
+		}
+		slog.Info("import archive", "file", src, "to", ts.File)
+
+		pw := &partWriter{backend: backend, archive: ts.File, state: state, label: label}
+		cw := &countWriter{W: pw}
+		tw := tar.NewWriter(cw)
+		f, err := openCompressed(src)
+		if err != nil {
+			return err
+		}
+		_, err = copyTar(tw, f, "")
+		if err == nil {
+			err = f.Close()
+		} else {
+			f.Close()
+		}
+		if err == nil && oid == "" && walTar != "" {
+			// like basebackup --wal, in the data directory archive
+			var n int
+			f, err = openCompressed(walTar)
+			if err != nil {
+				return err
+			}
+			n, err = copyTar(tw, f, "pg_wal/")
+			f.Close()
+			b.walSegments += n
+		}
+		if err == nil {
+			err = tw.Close()
+		}
+		if err == nil {
+			err = pw.Close()
+		}
+		if err != nil {
+			return fmt.Errorf("%s: %s", src, err)
+		}
+		ts.Parts = pw.parts
+		meta.Size += cw.N
+		meta.Tablespaces = append(meta.Tablespaces, ts)
+	}
+	meta.Wal = b.walSegments > 0 && meta.EndLsn != 0
+
+	if manifest != nil {
+		err = putObject(backend, meta.Manifest, manifest)
+		if err != nil {
+			return err
+		}
+		meta.ManifestSize, meta.ManifestSha256, meta.ManifestEncSha256 = sums(meta.Manifest, manifest)
+	}
+	d, err := json.Marshal(&meta)
+	if err != nil {
+		return err
+	}
+	err = putObject(backend, metaFile(meta.File), d)
+	if err != nil {
+		return err
+	}
+	for _, f := range state.unused(&meta) {
+		err := backend.Delete(f)
+		if err != nil {
+			slog.Warn("delete", "file", f, "err", err)
+		}
+	}
+	os.Remove(uploadStateFile(label))
+
+	slog.Info("base backup imported", "file", meta.File, "lsn", meta.StartLsn, "endLsn", meta.EndLsn, "bytes", meta.Size, "wal", meta.Wal)
+	return nil
+}
+
+type countWriter struct {
+	W io.Writer
+	N int64
+}
+
+func (w *countWriter) Write(p []byte) (int, error) {
+	n, err := w.W.Write(p)
+	w.N += int64(n)
+	return n, err
+}
+
+// isSegmentName tells if name is that of a wal segment, like
+// 000000010000000700000009
+func isSegmentName(name string) bool {
+	if len(name) != 24 {
+		return false
+	}
+	for _, c := range name {
+		if !strings.ContainsRune("0123456789ABCDEF", c) {
+			return false
+		}
+	}
+	return true
+}
+
+// parseSegmentName is the inverse of segmentName
+func parseSegmentName(name string) (walSegment, bool) {
+	var timeline, log, seg uint64
+	if !isSegmentName(name) {
+		return walSegment{}, false
+	}
+	fmt.Sscanf(name, "%08X%08X%08X", &timeline, &log, &seg)
+	if timeline == 0 || seg >= 1<<32/segmentSize {
+		return walSegment{}, false
+	}
+	return walSegment{log<<32/segmentSize | seg, int(timeline)}, true
+}
+
+// archiveObject names the object a file postgres archives is stored as:
+// wal segments like streamed ones, timeline history files as %08x.history
+// and backup history files as %016x.%d.%08x.backup
+func archiveObject(name string) (string, bool) {
+	if s, ok := parseSegmentName(name); ok {
+		return s.File(), true
+	}
+	var timeline int
+	if n, _ := fmt.Sscanf(name, "%08X.history", &timeline); n == 1 && len(name) == 16 && timeline > 0 {
+		return historyFile(timeline), true
+	}
+	var offset uint32
+	if s, ok := parseSegmentName(strings.SplitN(name, ".", 2)[0]); ok && strings.HasSuffix(name, ".backup") {
+		if n, _ := fmt.Sscanf(name[24:], ".%08X.backup", &offset); n == 1 {
+			return fmt.Sprintf("%016x.%d.%08x.backup", s.Segment, s.Timeline, offset), true
+		}
+	}
+	return "", false
+}
+
+// storedAs tells if file is in storage with contents d, and fails if it is
+// with other contents. The encryption only depends on the name, so the
+// sha256 of what the backend stored tells. A segment that is stored cut
+// short, as the stream left it, counts as not stored.
+func storedAs(backend *Backend, file string, d []byte) (bool, error) {
+	rep, err := backend.Request("pgbackup.stat " + file)
+	if err != nil {
+		return false, err
+	}
+	var size int64
+	var encSum string
+	switch rep {
+	case "notFound":
+		return false, nil
+	case "unknownCommand":
+		// compare the contents
+	default:
+		if n, _ := fmt.Sscanf(rep, "%x %s", &size, &encSum); n != 2 {
+			return false, fmt.Errorf("%s: stat %q", file, rep)
+		}
+		n, _, sum := sums(file, d)
+		if size == n && encSum == sum {
+			return true, nil
+		}
+		if size >= n || !strings.HasSuffix(file, ".wal") {
+			return true, fmt.Errorf("%s is in storage with other contents", file)
+		}
+	}
+
+	stored, err := getObject(backend, file)
+	if _, ok := err.(replyError); ok {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	switch {
+	case bytes.Equal(stored, d):
+		return true, nil
+	case len(stored) < len(d) && bytes.HasPrefix(d, stored) && strings.HasSuffix(file, ".wal"):
+		slog.Info("replacing partial segment", "file", file, "bytes", len(stored))
+		return false, nil
+	}
+	return true, fmt.Errorf("%s is in storage with other contents", file)
+}
+
+// checkSegment checks d is a complete wal segment of our system at lsn
+func checkSegment(d []byte, lsn LSN) error {
+	if len(d) != segmentSize {
+		return fmt.Errorf("%d bytes, not a complete segment", len(d))
+	}
+	h, err := wal.ParsePageHeader(d)
+	if err != nil {
+		return err
+	}
+	if h.Magic < 0xd000 || h.Magic > 0xd1ff || h.Info&wal.LongHeader == 0 {
+		return errors.New("not a wal segment")
+	}
+	if h.SegSize != segmentSize {
+		return fmt.Errorf("segment size %d, only %d is supported", h.SegSize, segmentSize)
+	}
+	if h.SystemId != config.SystemId {
+		return fmt.Errorf("of system %d, expected %d", h.SystemId, config.SystemId)
+	}
+	if LSN(h.PageAddr) != lsn {
+		return fmt.Errorf("at %s, expected %s", LSN(h.PageAddr), lsn)
+	}
+	return nil
+}
+
+// putSegment uploads a complete wal segment and its index, with the
+// commits in it if the indexer saw the segment before it
+func putSegment(backend *Backend, s walSegment, d []byte, x *indexer) error {
+	x.Write(uint64(s.Lsn()), d)
+	ix := x.Take(s.Segment)
+	if ix == nil {
+		ix = &segmentIndex{Unindexed: true}
+	}
+	x.Next(uint64(s.Lsn()) + segmentSize)
+
+	file := s.File()
+	err := putObject(backend, file, d)
+	if err != nil {
+		return err
+	}
+	ix.Size, ix.Sha256, ix.EncSha256 = sums(file, d)
+	return putIndex(backend, s.Segment, s.Timeline, ix)
+}
+
+// ImportWal uploads the wal segments an archive_command copied to dir,
+// compressed with gzip or zstd or not. Segments already in storage are
+// skipped.
+func ImportWal(dir string) error {
+	fs, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	files := map[walSegment]string{}
+	var segs []walSegment
+	histories := map[string]string{} // object: file
+	for _, f := range fs {
+		name := f.Name()
+		for _, ext := range archiveExts {
+			if !strings.HasSuffix(name, ext) {
+				continue
+			}
+			if s, ok := parseSegmentName(strings.TrimSuffix(name, ext)); ok && files[s] == "" {
+				files[s] = name
+				segs = append(segs, s)
+			}
+			if o, ok := archiveObject(strings.TrimSuffix(name, ext)); ok && strings.HasSuffix(o, ".history") && histories[o] == "" {
+				histories[o] = name
+			}
+		}
+	}
+	sort.Slice(segs, func(i, j int) bool {
+		if segs[i].Timeline != segs[j].Timeline {
+			return segs[i].Timeline < segs[j].Timeline
+		}
+		return segs[i].Segment < segs[j].Segment
+	})
+	if len(segs) == 0 && len(histories) == 0 {
+		return fmt.Errorf("%s: no wal segments", dir)
+	}
+
+	backend, err := Connect()
+	if err != nil {
+		return err
+	}
+	defer backend.Close()
+
+	stored := map[string]bool{}
+	ls, err := backend.List("wal")
+	if err != nil {
+		return err
+	}
+	for _, f := range ls {
+		stored[f] = true
+	}
+
+	// the timeline history files, for recovery to follow a timeline switch,
+	// like pgbackup archive stores them
+	var imported, skipped int
+	for file, name := range histories {
+		f, err := openCompressed(filepath.Join(dir, name))
+		if err != nil {
+			return err
+		}
+		d, err := ioutil.ReadAll(f)
+		if err == nil {
+			err = f.Close()
+		} else {
+			f.Close()
+		}
+		if err != nil {
+			return fmt.Errorf("%s: %s", name, err)
+		}
+		stored, err := storedAs(backend, file, d)
+		if err != nil {
+			return fmt.Errorf("%s: %s", name, err)
+		}
+		if stored {
+			skipped++
+			continue
+		}
+		err = putObject(backend, file, d)
+		if err != nil {
+			return err
+		}
+		imported++
+		slog.Info("imported", "history", name, "file", file)
+	}
+
+	var x *indexer
+	var prev walSegment
+	for _, s := range segs {
+		file := filepath.Join(dir, files[s])
+		f, err := openCompressed(file)
+		if err != nil {
+			return err
+		}
+		d, err := ioutil.ReadAll(f)
+		if err == nil {
+			err = f.Close()
+		} else {
+			f.Close()
+		}
+		if err == nil {
+			err = checkSegment(d, s.Lsn())
+		}
+		if err != nil {
+			return fmt.Errorf("%s: %s", file, err)
+		}
+		// a partial segment the stream left is replaced
+		if stored[s.File()] {
+			same, err := storedAs(backend, s.File(), d)
+			if err != nil {
+				return fmt.Errorf("%s: %s", file, err)
+			}
+			if same {
+				skipped++
+				continue
+			}
+		}
+
+		// the commits are indexed across consecutive segments
+		if x == nil || s.Timeline != prev.Timeline || s.Segment != prev.Segment+1 {
+			x = newIndexer(s.Lsn())
+		}
+		prev = s
+		err = putSegment(backend, s, d, x)
+		if err != nil {
+			return err
+		}
+		imported++
+		slog.Info("imported", "segment", files[s], "file", s.File())
+	}
+	slog.Info("wal imported", "files", imported, "skipped", skipped)
+	return nil
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestImportBase(t *testing.T) {
+	b := startBackend(t)
+	control := make([]byte, 8192)
+	binary.LittleEndian.PutUint64(control, config.SystemId)
+
+	dir := t.TempDir()
+	var gz bytes.Buffer
+	zw := gzip.NewWriter(&gz)
+	zw.Write(testTar(t, map[string]string{
+		"backup_label":      "START WAL LOCATION: 0/5000028 (file 000000010000000000000005)\nSTART TIMELINE: 1\nLABEL: nightly\n",
+		"PG_VERSION":        "16\n",
+		"base/5/1259":       "pg_class",
+		"global/pg_control": string(control),
+		"pg_tblspc/16400":   "->/srv/ts",
+	}))
+	zw.Close()
+	ioutil.WriteFile(filepath.Join(dir, "base.tar.gz"), gz.Bytes(), 0600)
+	ioutil.WriteFile(filepath.Join(dir, "16400.tar"), testTar(t, map[string]string{"PG_16_202307071/5/16401": "rows"}), 0600)
+	ioutil.WriteFile(filepath.Join(dir, "pg_wal.tar"), testTar(t, map[string]string{"000000010000000000000005": "wal"}), 0600)
+	manifest := []byte(`{"PostgreSQL-Backup-Manifest-Version": 1, "WAL-Ranges": [{"Timeline": 1, "Start-LSN": "0/5000028", "End-LSN": "0/5000138"}]}` + "\n")
+	ioutil.WriteFile(filepath.Join(dir, "backup_manifest"), manifest, 0600)
+
+	err := ImportBase(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b.wait(t, "0000000000000005.meta")
+	bases, err := listBasesNow()
+	if err != nil || len(bases) != 1 {
+		t.Fatalf("bases %v, %v", bases, err)
+	}
+	m := bases[0]
+	// the time of the tarball is when it was copied last, not the end
+	if m.File != "0000000000000005.base" || m.StartLsn != 0x5000028 || m.EndLsn != 0x5000138 || !m.EndTime.IsZero() || m.Label != "nightly" || !m.Wal || len(m.Tablespaces) != 2 || m.Tablespaces[0].Location != "/srv/ts" {
+		t.Errorf("meta %+v", m)
+	}
+
+	tmp := t.TempDir()
+	err = Restore(restoreOptions{Latest: true, Dir: filepath.Join(tmp, "data"), TablespaceMap: tablespaceMap{"/srv/ts": filepath.Join(tmp, "ts")}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for file, want := range map[string]string{"data/base/5/1259": "pg_class", "data/pg_wal/000000010000000000000005": "wal", "ts/PG_16_202307071/5/16401": "rows"} {
+		if d, _ := ioutil.ReadFile(filepath.Join(tmp, file)); string(d) != want {
+			t.Errorf("%s: %q", file, d)
+		}
+	}
+	if err := ImportBase(dir); err == nil || !strings.Contains(err.Error(), "already") {
+		t.Errorf("imported twice: %v", err)
+	}
+
+	// not ours
+	binary.LittleEndian.PutUint64(control, 42)
+	other := t.TempDir()
+	ioutil.WriteFile(filepath.Join(other, "base.tar"), testTar(t, map[string]string{
+		"backup_label":      "START WAL LOCATION: 0/7000028 (file 000000010000000000000007)\n",
+		"global/pg_control": string(control),
+	}), 0600)
+	if err := ImportBase(other); err == nil || !strings.Contains(err.Error(), "of system 42") {
+		t.Errorf("imported another system: %v", err)
+	}
+}
+
+func TestImportWal(t *testing.T) {
+	b := startBackend(t)
+	dir := t.TempDir()
+	for i := 1; i <= 3; i++ {
+		ioutil.WriteFile(filepath.Join(dir, segmentName(1, LSN(i)<<24)), testSegment(LSN(i)<<24), 0600)
+	}
+	ioutil.WriteFile(filepath.Join(dir, "000000010000000000000004.partial"), []byte{4}, 0600)
+	b.putEncrypted(walSegment{1, 1}.File(), testSegment(1 << 24)[:8192]) // streamed partly
+	history := []byte("1\t0/3000100\tno recovery target specified\n")
+	var gz bytes.Buffer
+	zw := gzip.NewWriter(&gz)
+	zw.Write(history)
+	zw.Close()
+	ioutil.WriteFile(filepath.Join(dir, "00000002.history.gz"), gz.Bytes(), 0600)
+
+	err := ImportWal(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 1; i <= 3; i++ {
+		file := walSegment{uint64(i), 1}.File()
+		if !bytes.Equal(b.decrypted(t, file), testSegment(LSN(i)<<24)) {
+			t.Errorf("%s: wrong contents", file)
+		}
+		var ix segmentIndex
+		json.Unmarshal(b.decrypted(t, indexFile(uint64(i), 1)), &ix)
+		stored, _ := b.file(file)
+		if ix.Sha256 == "" || checkSums(file, stored, ix.Size, ix.Sha256, ix.EncSha256) != nil {
+			t.Errorf("%s: index %+v", file, ix)
+		}
+	}
+	if _, ok := b.file(walSegment{4, 1}.File()); ok {
+		t.Error("imported a partial segment")
+	}
+	if !bytes.Equal(b.decrypted(t, historyFile(2)), history) {
+		t.Error("history file not imported")
+	}
+	err = ImportWal(dir)
+	if err != nil {
+		t.Errorf("imported again: %v", err)
+	}
+
+	// stored with other contents
+	seg2, _ := b.file(walSegment{2, 1}.File())
+	b.putEncrypted(walSegment{2, 1}.File(), []byte("streamed"))
+	err = ImportWal(dir)
+	if err == nil || !strings.Contains(err.Error(), "in storage with other contents") {
+		t.Errorf("other contents: %v", err)
+	}
+	if !bytes.Equal(b.decrypted(t, walSegment{2, 1}.File()), []byte("streamed")) {
+		t.Error("overwrote a stored segment")
+	}
+	b.put(walSegment{2, 1}.File(), seg2)
+
+	// misnamed
+	os.Remove(filepath.Join(b.dir, walSegment{3, 1}.File()))
+	os.Rename(filepath.Join(dir, segmentName(1, 3<<24)), filepath.Join(dir, segmentName(1, 5<<24)))
+	err = ImportWal(dir)
+	if err == nil || !strings.Contains(err.Error(), fmt.Sprintf("at %s, expected %s", LSN(3<<24), LSN(5<<24))) {
+		t.Errorf("misnamed segment: %v", err)
+	}
+}
+
+func TestFindBaseUnknownEnd(t *testing.T) {
+	full := &baseMeta{File: "0000000000000002.base", StartLsn: 0x2000028, EndLsn: 0x2000100}
+	imported := &baseMeta{File: "0000000000000004.base", StartLsn: 0x4000028} // without a manifest
+	bases := []*baseMeta{full, imported}
+
+	if m, err := findBase(bases, "0/5000000"); m != full {
+		t.Errorf("by lsn: %v, %v", m, err)
+	}
+	if m, err := findBase(bases, "0000000000000004"); m != imported {
+		t.Errorf("by name: %v, %v", m, err)
+	}
+}
@@ -0,0 +1,297 @@
+package main
+
+// combines a chain of incremental base backups into a full data directory,
+// like pg_combinebackup
+// https://github.com/postgres/postgres/blob/master/src/bin/pg_combinebackup/reconstruct.c
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	incrementalMagic  = 0xd3ae1f0d
+	incrementalPrefix = "INCREMENTAL."
+	blockSize         = 8192
+)
+
+// incrementalFile is an INCREMENTAL.<name> file of an incremental backup,
+// holding the blocks changed since the parent backup
+type incrementalFile struct {
+	path       string
+	blocks     []uint32 // block numbers, in the order stored
+	truncation uint32   // the file was at most this long (in blocks) since the parent
+	header     int64    // offset of the first block
+}
+
+func readIncremental(path string) (*incrementalFile, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	rd := bufio.NewReader(f)
+
+	var h [3]uint32 // magic, number of blocks, truncation block length
+	err = binary.Read(rd, binary.LittleEndian, &h)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", path, err)
+	}
+	if h[0] != incrementalMagic {
+		return nil, fmt.Errorf("%s: not an incremental file", path)
+	}
+	if h[1] > 1<<20 { // a 1GB relation segment has 131072 blocks
+		return nil, fmt.Errorf("%s: invalid number of blocks %d", path, h[1])
+	}
+	inc := &incrementalFile{path: path, blocks: make([]uint32, h[1]), truncation: h[2]}
+	err = binary.Read(rd, binary.LittleEndian, inc.blocks)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", path, err)
+	}
+
+	// block data is aligned to the block size, if there is any
+	inc.header = int64(12 + 4*len(inc.blocks))
+	if len(inc.blocks) > 0 && inc.header%blockSize != 0 {
+		inc.header += blockSize - inc.header%blockSize
+	}
+	return inc, nil
+}
+
+// reconstructFile writes rel, of which the newest of dirs holds an
+// incremental version, from the blocks in it and the older dirs
+func reconstructFile(dirs []string, rel, out string) error {
+	latest, err := readIncremental(filepath.Join(dirs[len(dirs)-1], incrementalName(rel)))
+	if err != nil {
+		return err
+	}
+
+	type source struct {
+		path   string
+		offset int64
+	}
+	length := latest.truncation
+	for _, b := range latest.blocks {
+		if b+1 > length {
+			length = b + 1
+		}
+	}
+	sources := make([]*source, length)
+	for i, b := range latest.blocks {
+		sources[b] = &source{latest.path, latest.header + int64(i)*blockSize}
+	}
+
+	// older backups can't provide blocks past where the file was truncated
+	// since, those are zero unless the latest backup has them
+	for i := len(dirs) - 2; i >= 0; i-- {
+		full := filepath.Join(dirs[i], rel)
+		if st, err := os.Stat(full); err == nil {
+			for b := uint32(0); b < latest.truncation && int64(b) < st.Size()/blockSize; b++ {
+				if sources[b] == nil {
+					sources[b] = &source{full, int64(b) * blockSize}
+				}
+			}
+			break
+		}
+
+		inc, err := readIncremental(filepath.Join(dirs[i], incrementalName(rel)))
+		if os.IsNotExist(err) {
+			break // created after this backup
+		}
+		if err != nil {
+			return err
+		}
+		for j, b := range inc.blocks {
+			if b < latest.truncation && sources[b] == nil {
+				sources[b] = &source{inc.path, inc.header + int64(j)*blockSize}
+			}
+		}
+	}
+
+	w, err := os.OpenFile(out, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	defer w.Close()
+	bw := bufio.NewWriter(w)
+
+	files := map[string]*os.File{}
+	defer func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}()
+
+	var zero, block [blockSize]byte
+	for _, s := range sources {
+		if s == nil {
+			_, err = bw.Write(zero[:])
+			if err != nil {
+				return err
+			}
+			continue
+		}
+		f := files[s.path]
+		if f == nil {
+			f, err = os.Open(s.path)
+			if err != nil {
+				return err
+			}
+			files[s.path] = f
+		}
+		_, err = f.ReadAt(block[:], s.offset)
+		if err != nil {
+			return fmt.Errorf("%s: %s", s.path, err)
+		}
+		_, err = bw.Write(block[:])
+		if err != nil {
+			return err
+		}
+	}
+	err = bw.Flush()
+	if err != nil {
+		return err
+	}
+	return w.Close()
+}
+
+func incrementalName(rel string) string {
+	return filepath.Join(filepath.Dir(rel), incrementalPrefix+filepath.Base(rel))
+}
+
+// combineBackups builds out from extracted archives dirs, oldest (the full
+// backup) first. The newest backup lists every file, so files deleted in
+// between are not restored.
+func combineBackups(dirs []string, out string) error {
+	newest := dirs[len(dirs)-1]
+	return filepath.Walk(newest, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(newest, path)
+		if err != nil || rel == "." {
+			return err
+		}
+		target := filepath.Join(out, rel)
+
+		switch {
+		case fi.IsDir():
+			return os.MkdirAll(target, fi.Mode().Perm())
+		case fi.Mode()&os.ModeSymlink != 0:
+			l, err := os.Readlink(path)
+			if err != nil {
+				return err
+			}
+			return os.Symlink(l, target)
+		case strings.HasPrefix(fi.Name(), incrementalPrefix):
+			rel = filepath.Join(filepath.Dir(rel), strings.TrimPrefix(fi.Name(), incrementalPrefix))
+			slog.Debug("reconstruct", "file", rel)
+			return reconstructFile(dirs, rel, filepath.Join(out, rel))
+		case rel == "backup_label":
+			return writeBackupLabel(path, target)
+		case rel == "backup_manifest":
+			return nil
+		default:
+			return os.Rename(path, target)
+		}
+	})
+}
+
+// writeBackupLabel copies the backup_label of an incremental backup without
+// its INCREMENTAL FROM lines, postgres refuses to start from those
+func writeBackupLabel(path, out string) error {
+	d, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	var b bytes.Buffer
+	for _, l := range strings.SplitAfter(string(d), "\n") {
+		if !strings.HasPrefix(l, "INCREMENTAL FROM ") {
+			b.WriteString(l)
+		}
+	}
+	return ioutil.WriteFile(out, b.Bytes(), 0600)
+}
+
+// baseChain returns the backups needed to restore base, the full backup
+// first
+func baseChain(bases []*baseMeta, base *baseMeta) ([]*baseMeta, error) {
+	chain := []*baseMeta{base}
+	for base.Parent != "" {
+		var parent *baseMeta
+		for _, m := range bases {
+			if m.File == base.Parent {
+				parent = m
+			}
+		}
+		if parent == nil {
+			return nil, fmt.Errorf("%s: parent %s is missing", base.File, base.Parent)
+		}
+		if len(chain) > len(bases) {
+			return nil, errors.New("loop in incremental base backups")
+		}
+		base = parent
+		chain = append([]*baseMeta{base}, chain...)
+	}
+	return chain, nil
+}
+
+// extractChain extracts an archive (the data directory or a tablespace oid)
+// of every backup in chain and combines them into dir
+func extractChain(backend *Backend, chain []*baseMeta, oid, dir string) error {
+	if len(chain) == 1 {
+		return extractObject(backend, chain[0], archiveFile(chain[0], oid), dir)
+	}
+
+	var dirs []string
+	defer func() {
+		for _, d := range dirs {
+			os.RemoveAll(d)
+		}
+	}()
+	for _, m := range chain {
+		d, err := ioutil.TempDir(filepath.Dir(filepath.Clean(dir)), ".pgbackup-")
+		if err != nil {
+			return err
+		}
+		dirs = append(dirs, d)
+
+		if !hasArchive(m, oid) {
+			continue // tablespace created after this backup
+		}
+		file := archiveFile(m, oid)
+		slog.Info("extract incremental", "file", file)
+		err = extractObject(backend, m, file, d)
+		if err != nil {
+			return err
+		}
+	}
+	return combineBackups(dirs, dir)
+}
+
+// archiveFile names the archive of tablespace oid in base, which older metas
+// don't list
+func archiveFile(base *baseMeta, oid string) string {
+	for _, ts := range base.Tablespaces {
+		if ts.Oid == oid && ts.File != "" {
+			return ts.File
+		}
+	}
+	return tablespaceFile(base.File, oid)
+}
+
+func hasArchive(base *baseMeta, oid string) bool {
+	for _, ts := range base.Tablespaces {
+		if ts.Oid == oid {
+			return true
+		}
+	}
+	return oid == ""
+}
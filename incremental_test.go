@@ -0,0 +1,138 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// testBlocks makes a block of each letter of s, '0' for a zero block
+func testBlocks(s string) []byte {
+	var d []byte
+	for _, c := range []byte(s) {
+		if c == '0' {
+			c = 0
+		}
+		d = append(d, bytes.Repeat([]byte{c}, blockSize)...)
+	}
+	return d
+}
+
+// testIncremental writes an INCREMENTAL file with a block of each letter of
+// data, numbered by blocks
+func testIncremental(t *testing.T, path string, truncation uint32, blocks []uint32, data string) {
+	t.Helper()
+	var b bytes.Buffer
+	binary.Write(&b, binary.LittleEndian, []uint32{incrementalMagic, uint32(len(blocks)), truncation})
+	binary.Write(&b, binary.LittleEndian, blocks)
+	if len(blocks) > 0 {
+		b.Write(make([]byte, blockSize-b.Len()%blockSize))
+	}
+	b.Write(testBlocks(data))
+	testFile(t, path, b.Bytes())
+}
+
+func testFile(t *testing.T, path string, d []byte) {
+	t.Helper()
+	err := os.MkdirAll(filepath.Dir(path), 0700)
+	if err == nil {
+		err = ioutil.WriteFile(path, d, 0600)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCombineBackups(t *testing.T) {
+	tmp := t.TempDir()
+	full, inc1, inc2, out := filepath.Join(tmp, "full"), filepath.Join(tmp, "inc1"), filepath.Join(tmp, "inc2"), filepath.Join(tmp, "out")
+
+	testFile(t, filepath.Join(full, "base/1/100"), testBlocks("AAAA"))
+	testFile(t, filepath.Join(full, "base/1/200"), testBlocks("AA"))
+	testFile(t, filepath.Join(full, "base/1/400"), testBlocks("A")) // dropped since
+	testFile(t, filepath.Join(full, "backup_label"), []byte("START WAL LOCATION: 0/2000028 (file 000000010000000000000002)\n"))
+
+	testIncremental(t, filepath.Join(inc1, "base/1/INCREMENTAL.100"), 4, []uint32{1}, "B")
+	testFile(t, filepath.Join(inc1, "base/1/300"), testBlocks("BB")) // created since
+	testIncremental(t, filepath.Join(inc1, "base/1/INCREMENTAL.200"), 2, nil, "")
+
+	// blocks from the newest backup go in the order of their numbers, a
+	// block past the truncation length that no backup has is zero
+	testIncremental(t, filepath.Join(inc2, "base/1/INCREMENTAL.100"), 3, []uint32{5, 2}, "DC")
+	testIncremental(t, filepath.Join(inc2, "base/1/INCREMENTAL.200"), 1, nil, "") // truncated
+	testIncremental(t, filepath.Join(inc2, "base/1/INCREMENTAL.300"), 2, []uint32{0}, "C")
+	testIncremental(t, filepath.Join(inc2, "base/1/INCREMENTAL.500"), 0, []uint32{0, 1}, "CC") // created since inc1
+	testFile(t, filepath.Join(inc2, "global/pg_control"), []byte("control"))
+	testFile(t, filepath.Join(inc2, "backup_manifest"), []byte("{}"))
+	testFile(t, filepath.Join(inc2, "backup_label"), []byte("START WAL LOCATION: 0/6000028 (file 000000010000000000000006)\n"+
+		"INCREMENTAL FROM LSN: 0/4000028\nINCREMENTAL FROM TLI: 1\nSTART TIMELINE: 1\n"))
+
+	err := os.Mkdir(out, 0700)
+	if err == nil {
+		err = combineBackups([]string{full, inc1, inc2}, out)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	for rel, want := range map[string]string{
+		"base/1/100":        string(testBlocks("ABC00D")),
+		"base/1/200":        string(testBlocks("A")),
+		"base/1/300":        string(testBlocks("CB")),
+		"base/1/500":        string(testBlocks("CC")),
+		"global/pg_control": "control",
+		"backup_label":      "START WAL LOCATION: 0/6000028 (file 000000010000000000000006)\nSTART TIMELINE: 1\n",
+	} {
+		d, err := ioutil.ReadFile(filepath.Join(out, rel))
+		if err != nil {
+			t.Errorf("%s: %s", rel, err)
+			continue
+		}
+		if string(d) != want {
+			t.Errorf("%s: %d bytes, want %d", rel, len(d), len(want))
+		}
+	}
+	for _, rel := range []string{"base/1/400", "base/1/INCREMENTAL.100", "backup_manifest"} {
+		if _, err := os.Stat(filepath.Join(out, rel)); err == nil {
+			t.Errorf("%s restored", rel)
+		}
+	}
+}
+
+func TestReadIncrementalInvalid(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "INCREMENTAL.100")
+	for i, d := range [][]byte{
+		[]byte("short"),
+		testBlocks("A"), // no magic
+		{0x0d, 0x1f, 0xae, 0xd3, 0, 0, 0, 1, 0, 0, 0, 0},             // too many blocks
+		{0x0d, 0x1f, 0xae, 0xd3, 2, 0, 0, 0, 0, 0, 0, 0, 1, 0, 0, 0}, // cut off block numbers
+	} {
+		testFile(t, path, d)
+		if _, err := readIncremental(path); err == nil || !strings.HasPrefix(err.Error(), path+": ") {
+			t.Errorf("%d: %v", i, err)
+		}
+	}
+}
+
+func TestBaseChain(t *testing.T) {
+	full := &baseMeta{File: "0000000000000002.base"}
+	inc1 := &baseMeta{File: "0000000000000004.base", Parent: full.File}
+	inc2 := &baseMeta{File: "0000000000000006.base", Parent: inc1.File}
+	orphan := &baseMeta{File: "0000000000000008.base", Parent: "0000000000000007.base"}
+	bases := []*baseMeta{full, inc1, inc2, orphan}
+
+	chain, err := baseChain(bases, inc2)
+	if err != nil || len(chain) != 3 || chain[0] != full || chain[2] != inc2 {
+		t.Errorf("chain %v, %v", chain, err)
+	}
+	if _, err := baseChain(bases, orphan); err == nil {
+		t.Error("chain without its parent")
+	}
+	full.Parent = inc2.File
+	if _, err := baseChain(bases, inc2); err == nil {
+		t.Error("chain with a loop")
+	}
+}
@@ -0,0 +1,291 @@
+package main
+
+import (
+	"crypto/cipher"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"log/slog"
+	"strings"
+	"time"
+
+	"./wal"
+)
+
+// segmentIndex is the sidecar object %016x.%d.idx uploaded next to every
+// completed wal segment. It holds the first and last commit (or abort) in
+// the segment, so times can be mapped to lsns without downloading wal.
+type segmentIndex struct {
+	Commits   int        `json:"commits"`
+	FirstTime *time.Time `json:"firstTime,omitempty"`
+	LastTime  *time.Time `json:"lastTime,omitempty"`
+	FirstXid  uint32     `json:"firstXid,omitempty"`
+	LastXid   uint32     `json:"lastXid,omitempty"`
+	FirstLsn  LSN        `json:"firstLsn,omitempty"`
+	LastLsn   LSN        `json:"lastLsn,omitempty"`
+	Unindexed bool       `json:"unindexed,omitempty"` // the commits are unknown
+
+	// of the segment as uploaded, older indexes don't have these
+	Size      int64  `json:"size,omitempty"`
+	Sha256    string `json:"sha256,omitempty"`    // of the plain contents
+	EncSha256 string `json:"encSha256,omitempty"` // of the encrypted contents
+}
+
+// objectSum sums an object as it is uploaded, write the plain contents to
+// it and the encrypted contents to enc
+type objectSum struct {
+	size       int64
+	plain, enc hash.Hash
+}
+
+func newObjectSum() *objectSum {
+	return &objectSum{plain: sha256.New(), enc: sha256.New()}
+}
+
+func (s *objectSum) Write(p []byte) (int, error) {
+	s.size += int64(len(p))
+	return s.plain.Write(p)
+}
+
+// Sums returns the size and the hex sha256 of the plain and encrypted
+// contents
+func (s *objectSum) Sums() (int64, string, string) {
+	return s.size, hex.EncodeToString(s.plain.Sum(nil)), hex.EncodeToString(s.enc.Sum(nil))
+}
+
+// getSegments downloads wal segments along with their indexes, and calls fn
+// in order with the plain contents of each and whether it was checked
+// against the sums in its index (older ones have none, nor does the segment
+// being streamed), or with the error, eg notFound or a checksum mismatch
+func getSegments(backend *Backend, segs []walSegment, fn func(s walSegment, d []byte, checked bool, err error) error) error {
+	var files []string
+	for _, s := range segs {
+		files = append(files, indexFile(s.Segment, s.Timeline), s.File())
+	}
+	var ix *segmentIndex
+	var ixErr error
+	return backend.GetAll(files, func(file string, d []byte, err error) error {
+		if strings.HasSuffix(file, ".idx") {
+			ix, ixErr = nil, nil
+			if err == nil {
+				aesStream(file).XORKeyStream(d, d)
+				ix = &segmentIndex{}
+				if err := json.Unmarshal(d, ix); err != nil {
+					ixErr = fmt.Errorf("%s: %s", file, err)
+				}
+			}
+			return nil
+		}
+
+		s := segs[0]
+		segs = segs[1:]
+		if err == nil {
+			err = ixErr
+		}
+		if err != nil {
+			return fn(s, nil, false, err)
+		}
+		checked := ix != nil && ix.Sha256 != ""
+		if checked {
+			err = checkSums(file, d, ix.Size, ix.Sha256, ix.EncSha256)
+			if err != nil {
+				return fn(s, nil, false, err)
+			}
+		}
+		aesStream(file).XORKeyStream(d, d)
+		return fn(s, d, checked, nil)
+	})
+}
+
+// sums returns what an objectSum would for uploading plain as file
+func sums(file string, plain []byte) (int64, string, string) {
+	s := newObjectSum()
+	s.Write(plain)
+	w := &cipher.StreamWriter{W: s.enc, S: aesStream(file)}
+	w.Write(plain)
+	return s.Sums()
+}
+
+// checkSums compares an object d (encrypted, as downloaded) with the sums an
+// index or meta has for it, if any
+func checkSums(file string, d []byte, size int64, sum, encSum string) error {
+	if sum == "" {
+		return nil
+	}
+	if int64(len(d)) != size {
+		return fmt.Errorf("%s: %d bytes, expected %d", file, len(d), size)
+	}
+	if encSum != "" {
+		h := sha256.Sum256(d)
+		if hex.EncodeToString(h[:]) != encSum {
+			return fmt.Errorf("%s: checksum mismatch of the encrypted contents", file)
+		}
+	}
+	p := make([]byte, len(d))
+	aesStream(file).XORKeyStream(p, d)
+	h := sha256.Sum256(p)
+	if hex.EncodeToString(h[:]) != sum {
+		return fmt.Errorf("%s: checksum mismatch", file)
+	}
+	return nil
+}
+
+func indexFile(segment uint64, timeline int) string {
+	return fmt.Sprintf("%016x.%d.idx", segment, timeline)
+}
+
+// indexer decodes the streamed wal and collects a segmentIndex per segment.
+// Records are counted in the segment they end in, as that is the segment
+// needed to replay them.
+type indexer struct {
+	dec    *wal.Decoder
+	from   uint64 // first segment the decoder saw completely
+	broken bool   // decoder failed in the current segment
+	segs   map[uint64]*segmentIndex
+}
+
+func newIndexer(lsn LSN) *indexer {
+	x := &indexer{segs: map[uint64]*segmentIndex{}}
+	x.restart(uint64(lsn))
+	return x
+}
+
+func (x *indexer) restart(lsn uint64) {
+	x.dec = wal.NewDecoder(lsn)
+	x.dec.OnRecord = x.record
+	x.from = lsn >> 24
+	x.broken = false
+}
+
+func (x *indexer) record(r *wal.Record) error {
+	if r.Rmid != wal.RmXact {
+		return nil
+	}
+	d, err := r.Decode()
+	if err != nil {
+		slog.Debug("index: can't decode record", "lsn", LSN(r.Lsn), "err", err)
+		return nil
+	}
+	t, ok := r.XactTime(d)
+	if !ok {
+		return nil
+	}
+
+	segment := (r.End() - 1) >> 24
+	ix := x.segs[segment]
+	if ix == nil {
+		ix = &segmentIndex{}
+		x.segs[segment] = ix
+	}
+	ix.Commits++
+	if ix.FirstTime == nil {
+		ix.FirstTime, ix.FirstXid, ix.FirstLsn = &t, r.Xid, LSN(r.Lsn)
+	}
+	ix.LastTime, ix.LastXid, ix.LastLsn = &t, r.Xid, LSN(r.Lsn)
+	return nil
+}
+
+func (x *indexer) Write(lsn uint64, p []byte) {
+	if x.broken {
+		return
+	}
+	if lsn != x.dec.Pos() {
+		slog.Warn("index: unexpected wal position", "lsn", LSN(lsn))
+		x.broken = true
+		return
+	}
+	_, err := x.dec.Write(p)
+	if err != nil {
+		slog.Warn("index: can't decode wal", "err", err)
+		x.broken = true
+	}
+}
+
+// Take returns the index of a completed segment, or nil if we can't vouch
+// for it
+func (x *indexer) Take(segment uint64) *segmentIndex {
+	ix := x.segs[segment]
+	delete(x.segs, segment)
+	if x.broken || segment < x.from {
+		return nil
+	}
+	if ix == nil {
+		ix = &segmentIndex{}
+	}
+	return ix
+}
+
+// Next is called when the stream enters a new segment at lsn
+func (x *indexer) Next(lsn uint64) {
+	if x.broken {
+		x.restart(lsn)
+	}
+}
+
+// putIndex uploads ix for segment
+func putIndex(backend *Backend, segment uint64, timeline int, ix *segmentIndex) error {
+	d, err := json.Marshal(ix)
+	if err != nil {
+		return err
+	}
+	return putObject(backend, indexFile(segment, timeline), d)
+}
+
+// fetchIndexes downloads all segment indexes
+func fetchIndexes(backend *Backend) (map[walSegment]*segmentIndex, error) {
+	files, err := backend.List("idx")
+	if err != nil {
+		return nil, err
+	}
+	ixs := map[walSegment]*segmentIndex{}
+	segments := map[string]walSegment{}
+	var get []string
+	for _, f := range files {
+		var s walSegment
+		if n, _ := fmt.Sscanf(f, "%016x.%d.idx", &s.Segment, &s.Timeline); n == 2 {
+			segments[f] = s
+			get = append(get, f)
+		}
+	}
+	err = backend.GetAll(get, func(f string, d []byte, err error) error {
+		if err != nil {
+			return fmt.Errorf("%s: %s", f, err)
+		}
+		aesStream(f).XORKeyStream(d, d)
+		var ix segmentIndex
+		if err := json.Unmarshal(d, &ix); err != nil {
+			return fmt.Errorf("%s: %s", f, err)
+		}
+		ixs[segments[f]] = &ix
+		return nil
+	})
+	return ixs, err
+}
+
+// parseTime parses a recovery target time, in local time unless a zone is
+// given
+func parseTime(s string) (time.Time, error) {
+	for _, layout := range []string{time.RFC3339Nano, "2006-01-02 15:04:05Z07:00", "2006-01-02 15:04:05", "2006-01-02"} {
+		if t, err := time.ParseInLocation(layout, s, time.Local); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("invalid time: %s", s)
+}
+
+// segmentForTime finds the first segment (on the highest timeline) with a
+// commit at or after t, which is the last segment needed to recover to t
+func segmentForTime(ixs map[walSegment]*segmentIndex, t time.Time) (walSegment, bool) {
+	var segs []walSegment
+	for s := range ixs {
+		segs = append(segs, s)
+	}
+	for _, s := range segmentTimelines(segs) {
+		if ix := ixs[s]; ix != nil && ix.LastTime != nil && !ix.LastTime.Before(t) {
+			return s, true
+		}
+	}
+	return walSegment{}, false
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+)
+
+// setupLogging installs the default slog logger as configured by logFormat
+// ("text" or "json") and logLevel ("debug", "info", "warn" or "error")
+func setupLogging() error {
+	var level slog.Level
+	if config.LogLevel != "" {
+		err := level.UnmarshalText(([]byte)(config.LogLevel))
+		if err != nil {
+			return err
+		}
+	}
+	opts := &slog.HandlerOptions{Level: level}
+
+	var h slog.Handler
+	switch strings.ToLower(config.LogFormat) {
+	case "", "text":
+		h = slog.NewTextHandler(os.Stderr, opts)
+	case "json":
+		h = slog.NewJSONHandler(os.Stderr, opts)
+	default:
+		return errors.New("invalid logFormat: " + config.LogFormat)
+	}
+
+	slog.SetDefault(slog.New(h).With("systemId", config.SystemId))
+	return nil
+}
+
+func fatal(err interface{}) {
+	slog.Error(fmt.Sprint(err))
+	os.Exit(1)
+}
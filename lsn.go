@@ -13,6 +13,21 @@ func (lsn LSN) String() string {
 	return fmt.Sprintf("%x/%08x", uint64(lsn)>>32, uint64(lsn)&0xffffffff)
 }
 
+func (lsn LSN) MarshalText() ([]byte, error) {
+	return ([]byte)(lsn.String()), nil
+}
+
+func (lsn *LSN) UnmarshalText(b []byte) error {
+	l, err := ParseLSN(string(b))
+	*lsn = l
+	return err
+}
+
+// segmentName returns the postgres wal file name of the segment containing lsn
+func segmentName(timeline int, lsn LSN) string {
+	return fmt.Sprintf("%08X%08X%08X", timeline, uint64(lsn)>>32, (uint64(lsn)>>24)&0xff)
+}
+
 func ParseLSN(s string) (LSN, error) {
 	if ss := strings.Split(s, "/"); len(ss) == 2 {
 		if a, err := strconv.ParseUint(ss[0], 16, 64); err == nil {
@@ -0,0 +1,396 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"./pg/pgtest"
+)
+
+func startPg(t *testing.T, s *pgtest.Server) *pgtest.Server {
+	t.Helper()
+	s.SystemId = config.SystemId
+	err := s.Start()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(s.Close)
+	config.PgConn = s.ConnString()
+	return s
+}
+
+func TestStream(t *testing.T) {
+	b := startBackend(t)
+	b.put("0000000000000001.1.wal", nil) // continue from segment 1
+	startPg(t, &pgtest.Server{WALEnd: 0x3800000, Chunk: 1 << 20})
+
+	err := Stream()
+	if err == nil || err.Error() != "server stopped" {
+		t.Fatalf("stream: %v", err)
+	}
+	b.wait(t, "0000000000000002.1.idx")
+
+	for _, segment := range []uint64{1, 2} {
+		file := walSegment{segment, 1}.File()
+		wal := pgtest.WAL(segment<<24, segmentSize)
+		if !bytes.Equal(b.decrypted(t, file), wal) {
+			t.Errorf("%s: wrong contents", file)
+		}
+
+		// the fake wal has no records to index, but it has checksums
+		var ix segmentIndex
+		err := json.Unmarshal(b.decrypted(t, indexFile(segment, 1)), &ix)
+		stored, _ := b.file(file)
+		if err != nil || !ix.Unindexed || checkSums(file, stored, ix.Size, ix.Sha256, ix.EncSha256) != nil {
+			t.Errorf("%s: index %+v, %v", file, ix, err)
+		}
+		if sum := sha256.Sum256(wal); ix.Sha256 != hex.EncodeToString(sum[:]) {
+			t.Errorf("%s: sha256 %s", file, ix.Sha256)
+		}
+	}
+	if _, ok := b.file("0000000000000003.1.wal"); ok {
+		t.Error("incomplete segment stored")
+	}
+}
+
+func TestStreamKeepalive(t *testing.T) {
+	b := startBackend(t)
+	b.put("0000000000000001.1.wal", nil)
+	// a keepalive after every 16 messages, 4MB into a segment
+	startPg(t, &pgtest.Server{WALEnd: 0x3800000, Chunk: 256 << 10})
+
+	err := Stream()
+	if err == nil || err.Error() != "server stopped" {
+		t.Fatalf("stream: %v", err)
+	}
+	if streamMissing {
+		t.Error("keepalive taken for a missing segment")
+	}
+	b.wait(t, "0000000000000002.1.idx")
+	if !bytes.Equal(b.decrypted(t, "0000000000000002.1.wal"), pgtest.WAL(2<<24, segmentSize)) {
+		t.Error("segment 2 differs")
+	}
+}
+
+func TestStreamRemoved(t *testing.T) {
+	startBackend(t).put("0000000000000001.1.wal", nil)
+	s := startPg(t, &pgtest.Server{WALEnd: 0x3800000, RemovedBefore: 0x3000000})
+
+	err := Stream()
+	if err == nil || err.Error() != "server missing segment" {
+		t.Fatalf("stream: %v", err)
+	}
+
+	// restarts from the segment the server is in
+	err = Stream()
+	if err == nil || err.Error() != "server stopped" {
+		t.Fatalf("stream: %v", err)
+	}
+	q := s.Queries()
+	if q[len(q)-1] != "START_REPLICATION 0/03000000" {
+		t.Errorf("restarted with %s", q[len(q)-1])
+	}
+}
+
+func TestStreamHistory(t *testing.T) {
+	b := startBackend(t)
+	b.put("0000000000000002.2.wal", nil)
+	history := "1\t0/2800000\tno recovery target specified\n"
+	s := startPg(t, &pgtest.Server{Timeline: 2, History: map[int]string{2: history}, WALEnd: 0x3000000})
+
+	for i := 0; i < 2; i++ {
+		err := Stream()
+		if err == nil || err.Error() != "server stopped" {
+			t.Fatalf("stream: %v", err)
+		}
+		b.wait(t, historyFile(2))
+	}
+	if string(b.decrypted(t, historyFile(2))) != history {
+		t.Errorf("history %q", b.decrypted(t, historyFile(2)))
+	}
+	var n int
+	for _, q := range s.Queries() {
+		if q == "TIMELINE_HISTORY 2" {
+			n++
+		}
+	}
+	if n != 1 {
+		t.Errorf("history requested %d times", n)
+	}
+}
+
+func testTar(t *testing.T, files map[string]string) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	var names []string
+	for name := range files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		d := files[name]
+		h := &tar.Header{Name: name, Mode: 0600, Size: int64(len(d)), Typeflag: tar.TypeReg}
+		if strings.HasPrefix(d, "->") {
+			h = &tar.Header{Name: name, Mode: 0777, Typeflag: tar.TypeSymlink, Linkname: d[2:]}
+		}
+		if err := tw.WriteHeader(h); err != nil {
+			t.Fatal(err)
+		}
+		tw.Write([]byte(d))
+	}
+	tw.Close()
+	return buf.Bytes()
+}
+
+func TestBasebackupRestore(t *testing.T) {
+	b := startBackend(t)
+	s := startPg(t, &pgtest.Server{
+		Version:     "16.4",
+		BackupStart: 0x5000028,
+		BackupEnd:   0x5000138,
+		Chunk:       1000,
+		Tablespaces: []pgtest.Tablespace{
+			{Oid: "16400", Location: "/srv/ts", Tar: testTar(t, map[string]string{"PG_16_202307071/5/16401": "rows"})},
+			{Tar: testTar(t, map[string]string{
+				"PG_VERSION":      "16\n",
+				"backup_label":    "START WAL LOCATION: 0/5000028 (file 000000010000000000000005)\nLABEL: pgbackup\n",
+				"base/5/1259":     "pg_class",
+				"pg_tblspc/16400": "->/srv/ts",
+			})},
+		},
+		Manifest: []byte(`{"PostgreSQL-Backup-Manifest-Version": 1}` + "\n"),
+	})
+
+	partSize = 1024
+	defer func() { partSize = 64 << 20 }()
+	err := Basebackup(baseOptions{Manifest: true, Fast: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	q := s.Queries()
+	if q[len(q)-1] != "BASE_BACKUP (LABEL 'pgbackup', WAIT false, CHECKPOINT 'fast', MANIFEST 'yes', MANIFEST_CHECKSUMS 'SHA256')" {
+		t.Errorf("query %s", q[len(q)-1])
+	}
+	b.wait(t, "0000000000000005.meta")
+
+	var meta baseMeta
+	err = json.Unmarshal(b.decrypted(t, "0000000000000005.meta"), &meta)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if meta.StartLsn != 0x5000028 || meta.EndLsn != 0x5000138 || meta.Manifest != "0000000000000005.manifest" || len(meta.Tablespaces) != 2 || meta.Tablespaces[0].File != "0000000000000005.16400.tblspc" {
+		t.Errorf("meta %+v", meta)
+	}
+	for i, ts := range meta.Tablespaces {
+		var d []byte
+		for _, p := range ts.Parts {
+			d = append(d, b.decrypted(t, p.File)...)
+		}
+		if len(ts.Parts) < 2 || !bytes.Equal(d, s.Tablespaces[i].Tar) {
+			t.Errorf("archive %s differs, in %d parts", ts.File, len(ts.Parts))
+		}
+	}
+	if !bytes.Equal(b.decrypted(t, "0000000000000005.manifest"), s.Manifest) {
+		t.Error("manifest differs")
+	}
+
+	// restore it, with the tablespace somewhere else
+	tmp := t.TempDir()
+	err = Restore(restoreOptions{Latest: true, Dir: filepath.Join(tmp, "data"), TablespaceMap: tablespaceMap{"/srv/ts": filepath.Join(tmp, "ts")}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d, _ := ioutil.ReadFile(filepath.Join(tmp, "ts/PG_16_202307071/5/16401")); string(d) != "rows" {
+		t.Error("tablespace not restored")
+	}
+	if d, _ := ioutil.ReadFile(filepath.Join(tmp, "data/pg_tblspc/16400/PG_16_202307071/5/16401")); string(d) != "rows" {
+		t.Error("tablespace not linked")
+	}
+	if _, err := os.Stat(filepath.Join(tmp, "data/recovery.signal")); err != nil {
+		t.Error(err)
+	}
+	if d, _ := ioutil.ReadFile(filepath.Join(tmp, "data/postgresql.auto.conf")); !strings.Contains(string(d), "restore_command=") {
+		t.Errorf("postgresql.auto.conf: %s", d)
+	}
+
+	// a corrupt part fails the restore
+	part := meta.Tablespaces[1].Parts[1].File
+	d, _ := b.file(part)
+	d[10] ^= 1
+	b.put(part, d)
+	tmp = t.TempDir()
+	err = Restore(restoreOptions{Latest: true, Dir: filepath.Join(tmp, "data"), TablespaceMap: tablespaceMap{"/srv/ts": filepath.Join(tmp, "ts")}})
+	if err == nil || !strings.Contains(err.Error(), "checksum mismatch") {
+		t.Errorf("restored a corrupt backup: %v", err)
+	}
+}
+
+func TestBasebackupResume(t *testing.T) {
+	b := startBackend(t)
+	partSize = 2048
+	defer func() { partSize = 64 << 20 }()
+
+	files := map[string]string{"PG_VERSION": "16\n", "base/5/1249": "attributes", "base/5/1259": strings.Repeat("x", 4000), "global/1262": "databases"}
+	backup := func(start uint64, resume bool) *baseMeta {
+		t.Helper()
+		startPg(t, &pgtest.Server{
+			Version:     "16.4",
+			BackupStart: start,
+			BackupEnd:   start + 0x100,
+			Tablespaces: []pgtest.Tablespace{{Tar: testTar(t, files)}},
+		})
+		err := Basebackup(baseOptions{Label: "nightly", Resume: resume})
+		if err != nil {
+			t.Fatal(err)
+		}
+		bases, err := listBasesNow()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return bases[len(bases)-1]
+	}
+
+	// interrupted right before writing its meta
+	first := backup(0x5000028, false)
+	os.Remove(filepath.Join(b.dir, metaFile(first.File)))
+	state := &uploadState{File: first.File, Parts: map[string]basePart{}}
+	for _, p := range first.Tablespaces[0].Parts {
+		state.Parts[p.File] = p
+	}
+	state.save("nightly")
+	old := time.Now().Add(-time.Hour)
+	for f := range state.Parts {
+		os.Chtimes(filepath.Join(b.dir, f), old, old)
+	}
+
+	// the rerun starts later, a file before grew and the end of the big one
+	// changed, the parts in between and after line up again
+	files["base/5/1249"] = strings.Repeat("attributes", 70)
+	files["base/5/1259"] = strings.Repeat("x", 3000) + strings.Repeat("y", 1000)
+	m := backup(0x7000028, true)
+	if m.File != "0000000000000007.base" || m.StartLsn != 0x7000028 {
+		t.Fatalf("resumed as %s at %s", m.File, m.StartLsn)
+	}
+	var sent, changed int
+	used := map[string]bool{}
+	for _, p := range m.Tablespaces[0].Parts {
+		used[p.File] = true
+		if _, ok := state.Parts[p.File]; !ok && !strings.HasPrefix(p.File, m.File+".") {
+			t.Errorf("part %s", p.File)
+		}
+		st, err := os.Stat(filepath.Join(b.dir, p.File))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if st.ModTime().After(old.Add(time.Minute)) {
+			sent++
+		}
+		if state.Parts[p.File] != p {
+			changed++
+		}
+	}
+	if sent != changed || sent == 0 || sent == len(state.Parts) {
+		t.Errorf("sent %d parts again, %d of %d changed", sent, changed, len(state.Parts))
+	}
+	for f := range state.Parts {
+		if _, ok := b.file(f); ok != used[f] {
+			t.Errorf("interrupted part %s: stored %v, used %v", f, ok, used[f])
+		}
+	}
+	if _, err := os.Stat(uploadStateFile("nightly")); !os.IsNotExist(err) {
+		t.Error("upload state left")
+	}
+
+	// interrupted again, and resumed from the same position, like on a
+	// standby: no part name is used for other contents
+	os.Remove(filepath.Join(b.dir, metaFile(m.File)))
+	state = &uploadState{File: m.File, Parts: map[string]basePart{}}
+	for _, p := range m.Tablespaces[0].Parts {
+		state.Parts[p.File] = p
+	}
+	state.save("nightly")
+	files["base/5/1259"] = strings.Repeat("z", 4000)
+	again := backup(0x7000028, true)
+	for _, p := range again.Tablespaces[0].Parts {
+		if prev, ok := state.Parts[p.File]; ok && prev != p {
+			t.Errorf("%s reused for other contents", p.File)
+		}
+		sum := sha256.Sum256(b.decrypted(t, p.File))
+		if hex.EncodeToString(sum[:]) != p.Sha256 {
+			t.Errorf("%s: wrong contents", p.File)
+		}
+	}
+}
+
+func TestBasebackupIncrementalFallback(t *testing.T) {
+	startBackend(t)
+	s := startPg(t, &pgtest.Server{
+		Version:     "16.4",
+		BackupStart: 0x5000028,
+		BackupEnd:   0x5000138,
+		Tablespaces: []pgtest.Tablespace{{Tar: testTar(t, map[string]string{"PG_VERSION": "16\n"})}},
+		Manifest:    []byte(`{"PostgreSQL-Backup-Manifest-Version": 1}` + "\n"),
+	})
+
+	// as the daemon does with baseIncremental
+	opts := baseOptions{Manifest: true, Incremental: true, MaxChain: 3, Fallback: true}
+	for i := 0; i < 2; i++ {
+		err := Basebackup(opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		q := s.Queries()
+		if q[len(q)-1] != "BASE_BACKUP (LABEL 'pgbackup', WAIT false, MANIFEST 'yes', MANIFEST_CHECKSUMS 'SHA256')" {
+			t.Errorf("query %s", q[len(q)-1])
+		}
+	}
+	if s.UploadedManifest() != nil {
+		t.Error("uploaded a manifest")
+	}
+
+	opts.Fallback = false
+	err := Basebackup(opts)
+	if err == nil || !strings.Contains(err.Error(), "postgres 17") {
+		t.Errorf("incremental on 16: %v", err)
+	}
+}
+
+// listBasesNow lists the bases on a connection of its own
+func listBasesNow() ([]*baseMeta, error) {
+	backend, err := Connect()
+	if err != nil {
+		return nil, err
+	}
+	defer backend.Close()
+	return listBases(backend, false)
+}
+
+// stdout runs f and returns what it printed
+func stdout(f func() error) ([]byte, error) {
+	r, w, err := os.Pipe()
+	if err != nil {
+		return nil, err
+	}
+	saved := os.Stdout
+	os.Stdout = w
+	done := make(chan []byte)
+	go func() {
+		d, _ := ioutil.ReadAll(r)
+		done <- d
+	}()
+	err = f()
+	os.Stdout = saved
+	w.Close()
+	return <-done, err
+}
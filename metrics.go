@@ -0,0 +1,108 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// counters exported on /metrics, only touched through sync/atomic
+var metrics struct {
+	streamedBytes uint64
+	uploadedLsn   uint64 // end of the wal sent to the backend
+	serverLsn     uint64 // end of the wal on the server
+	caughtUp      int64  // unixnano when we last had all wal the server had
+	restarts      uint64
+	backendErrors uint64
+	baseTime      int64 // unix time of the last finished base backup
+	baseBytes     uint64
+}
+
+var startTime = time.Now()
+
+// backendErr counts err as a backend error, if any
+func backendErr(err error) error {
+	if err != nil {
+		atomic.AddUint64(&metrics.backendErrors, 1)
+	}
+	return err
+}
+
+// streamed updates the stream metrics after n bytes at lsn have been sent to
+// the backend, keepalives come in with n=0
+func streamed(lsn, serverLsn uint64, n int) {
+	atomic.AddUint64(&metrics.streamedBytes, uint64(n))
+	if n > 0 {
+		atomic.StoreUint64(&metrics.uploadedLsn, lsn+uint64(n))
+	}
+	atomic.StoreUint64(&metrics.serverLsn, serverLsn)
+	if atomic.LoadUint64(&metrics.uploadedLsn) >= serverLsn {
+		atomic.StoreInt64(&metrics.caughtUp, time.Now().UnixNano())
+	}
+}
+
+// lag returns the replication lag in bytes and seconds
+func lag() (uint64, float64) {
+	uploaded := atomic.LoadUint64(&metrics.uploadedLsn)
+	server := atomic.LoadUint64(&metrics.serverLsn)
+	var bytes uint64
+	if server > uploaded {
+		bytes = server - uploaded
+	}
+	since := startTime
+	if t := atomic.LoadInt64(&metrics.caughtUp); t != 0 {
+		since = time.Unix(0, t)
+	}
+	return bytes, time.Since(since).Seconds()
+}
+
+func serveMetrics() error {
+	l, err := net.Listen("tcp", config.MetricsListen)
+	if err != nil {
+		return err
+	}
+	slog.Info("serving metrics", "addr", l.Addr().String())
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		writeMetrics(w)
+	})
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		max := config.MaxLagSeconds
+		if max == 0 {
+			max = 300
+		}
+		bytes, seconds := lag()
+		if seconds > float64(max) {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			fmt.Fprintf(w, "lagging %.0fs (%d bytes) behind server\n", seconds, bytes)
+			return
+		}
+		fmt.Fprintf(w, "ok\n")
+	})
+	go http.Serve(l, mux)
+	return nil
+}
+
+func writeMetrics(w io.Writer) {
+	metric := func(name, typ, help string, v interface{}) {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n%s %v\n", name, help, name, typ, name, v)
+	}
+
+	lagBytes, lagSeconds := lag()
+
+	metric("pgbackup_wal_streamed_bytes_total", "counter", "Bytes of wal streamed to the backend.", atomic.LoadUint64(&metrics.streamedBytes))
+	metric("pgbackup_wal_uploaded_lsn", "gauge", "Lsn up to which wal has been sent to the backend.", atomic.LoadUint64(&metrics.uploadedLsn))
+	metric("pgbackup_wal_server_lsn", "gauge", "Current end of wal on the server.", atomic.LoadUint64(&metrics.serverLsn))
+	metric("pgbackup_replication_lag_bytes", "gauge", "Bytes of wal on the server not yet sent to the backend.", lagBytes)
+	metric("pgbackup_replication_lag_seconds", "gauge", "Seconds since the stream was last caught up with the server.", lagSeconds)
+	metric("pgbackup_stream_restarts_total", "counter", "Number of times the wal stream was restarted.", atomic.LoadUint64(&metrics.restarts))
+	metric("pgbackup_backend_errors_total", "counter", "Number of failed backend operations.", atomic.LoadUint64(&metrics.backendErrors))
+	metric("pgbackup_base_backup_timestamp_seconds", "gauge", "Unix time the last base backup finished.", atomic.LoadInt64(&metrics.baseTime))
+	metric("pgbackup_base_backup_bytes", "gauge", "Size of the last base backup.", atomic.LoadUint64(&metrics.baseBytes))
+}
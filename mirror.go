@@ -0,0 +1,332 @@
+package main
+
+// copies backups between storages as they are, encrypted, eg to keep a
+// copy in another region
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log/slog"
+	"strings"
+	"time"
+)
+
+// mirrorExts are the objects mirror copies, in this order: a base is only
+// complete on the other side with its meta, a segment with its index
+var mirrorExts = []string{"history", "backup", "wal", "idx", "part", "base", "tblspc", "manifest", "meta"}
+
+type mirrorOptions struct {
+	From, To string // names in storages, empty for the backend of pgbackup.conf
+	DryRun   bool
+	Verify   bool // download what a side can't stat to compare it
+}
+
+// findStorage looks up a storage by name
+func findStorage(name string) (*storage, error) {
+	if name == "" || name == "default" {
+		return &config.storage, nil
+	}
+	s := config.Storages[name]
+	if s == nil {
+		return nil, fmt.Errorf("no storage %s in ~/pgbackup.conf", name)
+	}
+	return s, nil
+}
+
+// Mirror copies the objects of storage opts.From that storage opts.To
+// doesn't have, or has with another size or sha256. It never deletes.
+func Mirror(opts mirrorOptions) error {
+	for _, name := range []*string{&opts.From, &opts.To} {
+		if *name == "" {
+			*name = "default"
+		}
+	}
+	from, err := findStorage(opts.From)
+	if err != nil {
+		return err
+	}
+	to, err := findStorage(opts.To)
+	if err != nil {
+		return err
+	}
+	if from == to {
+		return errors.New("mirror: --from and --to are the same storage")
+	}
+	src, err := ConnectTo(from)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	dst, err := ConnectTo(to)
+	if err != nil {
+		return err
+	}
+	defer dst.Close()
+
+	var copied, skipped int
+	var bytes int64
+	var sums map[string]string
+	for _, ext := range mirrorExts {
+		files, err := src.List(ext)
+		if err != nil {
+			return err
+		}
+		have, err := dst.List(ext)
+		if err != nil {
+			return err
+		}
+		if ext == "wal" {
+			files, err = finishedWal(src, files)
+			if err != nil {
+				return err
+			}
+		}
+
+		// objects on both sides are compared by size and sha256
+		var both []string
+		there := map[string]bool{}
+		for _, f := range have {
+			there[f] = true
+		}
+		for _, f := range files {
+			if there[f] {
+				both = append(both, f)
+			}
+		}
+		srcStats, err := src.statAll(both)
+		if err != nil {
+			return err
+		}
+		dstStats, err := dst.statAll(both)
+		if err != nil {
+			return err
+		}
+
+		for _, f := range files {
+			if there[f] {
+				if srcStats[f] == "unknownCommand" && sums == nil && !opts.Verify {
+					sums, err = storedSums(src)
+					if err != nil {
+						return err
+					}
+				}
+				same, err := sameObject(src, dst, f, srcStats[f], dstStats[f], sums, opts.Verify)
+				if err != nil {
+					return fmt.Errorf("%s: %s", f, err)
+				}
+				if same {
+					skipped++
+					continue
+				}
+			}
+			slog.Info("mirror", "file", f, "from", opts.From, "to", opts.To, "dryRun", opts.DryRun)
+			if opts.DryRun {
+				continue
+			}
+			n, err := mirrorObject(src, dst, f)
+			if err != nil {
+				return fmt.Errorf("%s: %s", f, err)
+			}
+			copied++
+			bytes += n
+		}
+		missing, err := dst.confirmPending()
+		if err != nil {
+			return err
+		}
+		if len(missing) > 0 {
+			return fmt.Errorf("%s not stored", strings.Join(missing, ", "))
+		}
+	}
+	slog.Info("mirrored", "copied", copied, "bytes", bytes, "skipped", skipped)
+	return nil
+}
+
+// statAll stats files, a few requests at a time. Backends without
+// pgbackup.stat reply unknownCommand to all.
+func (b *Backend) statAll(files []string) (map[string]string, error) {
+	stats := map[string]string{}
+	for len(files) > 0 {
+		n := len(files)
+		if n > getWindow {
+			n = getWindow
+		}
+		err := b.retry(func() error {
+			for _, f := range files[:n] {
+				err := b.Send("pgbackup.stat " + f)
+				if err != nil {
+					return err
+				}
+			}
+			for _, f := range files[:n] {
+				rep, err := b.reply()
+				if err != nil {
+					return err
+				}
+				stats[f] = rep
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+		files = files[n:]
+	}
+	return stats, nil
+}
+
+// sameObject tells if file is the same on both sides, by the size and
+// sha256 the sides report. For a source without pgbackup.stat those are the
+// ones in the index or meta object, and a destination without it is taken
+// to have the object under its name. With verify, a side without
+// pgbackup.stat is downloaded instead.
+func sameObject(src, dst *Backend, file, srcStat, dstStat string, sums map[string]string, verify bool) (bool, error) {
+	var err error
+	if srcStat == "unknownCommand" {
+		if verify {
+			srcStat, err = src.sumObject(file)
+		} else {
+			srcStat = sums[file]
+		}
+	}
+	if dstStat == "unknownCommand" {
+		if !verify {
+			return true, nil
+		}
+		dstStat, err = dst.sumObject(file)
+	}
+	if srcStat == "" {
+		return true, err // nothing to compare with
+	}
+	return srcStat == dstStat, err
+}
+
+// sumObject downloads file and returns its size and sha256 like
+// pgbackup.stat does
+func (b *Backend) sumObject(file string) (string, error) {
+	rd, n, err := b.Get(file)
+	if err != nil {
+		return "", err
+	}
+	h := sha256.New()
+	_, err = io.Copy(h, rd)
+	return fmt.Sprintf("%x %x", n, h.Sum(nil)), err
+}
+
+// storedSums collects the size and sha256 of the stored segments and base
+// backup parts from their index and meta objects, as pgbackup.stat would
+// report them
+func storedSums(b *Backend) (map[string]string, error) {
+	sums := map[string]string{}
+	idx, err := b.List("idx")
+	if err != nil {
+		return nil, err
+	}
+	err = b.GetAll(idx, func(f string, d []byte, err error) error {
+		if err != nil {
+			return fmt.Errorf("%s: %s", f, err)
+		}
+		aesStream(f).XORKeyStream(d, d)
+		var ix segmentIndex
+		if err := json.Unmarshal(d, &ix); err != nil {
+			return fmt.Errorf("%s: %s", f, err)
+		}
+		if ix.EncSha256 != "" {
+			sums[strings.TrimSuffix(f, ".idx")+".wal"] = fmt.Sprintf("%x %s", ix.Size, ix.EncSha256)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	bases, err := listBases(b, false)
+	if err != nil {
+		return nil, err
+	}
+	for _, m := range bases {
+		if m.ManifestEncSha256 != "" {
+			sums[m.Manifest] = fmt.Sprintf("%x %s", m.ManifestSize, m.ManifestEncSha256)
+		}
+		for _, ts := range m.Tablespaces {
+			for _, p := range ts.Parts {
+				if p.EncSha256 != "" {
+					sums[p.File] = fmt.Sprintf("%x %s", p.Size, p.EncSha256)
+				}
+			}
+		}
+	}
+	return sums, nil
+}
+
+// finishedWal leaves out the last segment of each timeline while it has no
+// index, it may still be streaming
+func finishedWal(b *Backend, files []string) ([]string, error) {
+	idx, err := b.List("idx")
+	if err != nil {
+		return nil, err
+	}
+	indexed := map[string]bool{}
+	for _, f := range idx {
+		indexed[strings.TrimSuffix(f, ".idx")+".wal"] = true
+	}
+	segs := parseWalList(files)
+	var finished []string
+	for i, s := range segs {
+		last := i == len(segs)-1 || segs[i+1].Timeline != s.Timeline
+		if !last || indexed[s.File()] {
+			finished = append(finished, s.File())
+		}
+	}
+	return finished, nil
+}
+
+// mirrorObject streams file from src to dst, and returns its size once dst
+// confirmed it
+func mirrorObject(src, dst *Backend, file string) (int64, error) {
+	var size int64
+	err := dst.retry(func() error {
+		rd, n, err := src.Get(file)
+		if err != nil {
+			return fmt.Errorf("get: %w", err) // a reply error isn't for dst to retry
+		}
+		err = dst.Send("pgbackup.put " + file)
+		if err != nil {
+			io.Copy(ioutil.Discard, rd)
+			return err
+		}
+		h := sha256.New()
+		cw := &chunkWriter{W: dst.C}
+		_, err = io.Copy(io.MultiWriter(cw, h), rd)
+		if err != nil {
+			return err
+		}
+		err = backendErr(cw.Close())
+		if err != nil {
+			return err
+		}
+		size = n
+		return dst.confirm(file, n, hex.EncodeToString(h.Sum(nil)))
+	})
+	return size, err
+}
+
+// mirrorForever keeps copying the backups to config.MirrorTo, for the daemon
+func mirrorForever() {
+	every := time.Duration(config.MirrorMinutes) * time.Minute
+	if every == 0 {
+		every = 10 * time.Minute
+	}
+	for {
+		err := Mirror(mirrorOptions{To: config.MirrorTo})
+		if err != nil {
+			slog.Error("mirror failed", "to", config.MirrorTo, "err", err)
+		}
+		time.Sleep(every)
+	}
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMirror(t *testing.T) {
+	b := startBackend(t)
+	off, s := serveTest(t, t.TempDir())
+	config.Storages = map[string]*storage{"offsite": &s}
+
+	files := []string{"0000000000000001.1.wal", indexFile(1, 1), "0000000000000002.1.wal", indexFile(2, 1), "00000002.history", "0000000000000005.base.6c1f02aa.0000.part", "0000000000000005.meta"}
+	for i, f := range files {
+		b.putEncrypted(f, bytes.Repeat([]byte{byte(i)}, 1000*i+1))
+	}
+	// there already, and the same
+	d, _ := b.file(files[0])
+	off.put(files[0], d)
+	old := time.Now().Add(-time.Hour)
+	os.Chtimes(filepath.Join(off.dir, files[0]), old, old)
+	// there already, but cut short
+	d, _ = b.file(files[2])
+	off.put(files[2], d[:10])
+	off.put("0000000000000009.1.wal", []byte("only offsite"))
+	// no index yet, it may still be streaming
+	b.putEncrypted("0000000000000003.1.wal", []byte("streaming"))
+
+	err := Mirror(mirrorOptions{To: "offsite"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range files {
+		want, _ := b.file(f)
+		if got, _ := off.file(f); !bytes.Equal(got, want) {
+			t.Errorf("%s: %d bytes, want %d", f, len(got), len(want))
+		}
+	}
+	if st, _ := os.Stat(filepath.Join(off.dir, files[0])); st.ModTime().After(old.Add(time.Minute)) {
+		t.Error("copied an object that was there")
+	}
+	if _, ok := off.file("0000000000000009.1.wal"); !ok {
+		t.Error("deleted an object")
+	}
+	if _, ok := off.file("0000000000000003.1.wal"); ok {
+		t.Error("copied a segment without index")
+	}
+
+	err = Mirror(mirrorOptions{From: "offsite", To: "offsite"})
+	if err == nil {
+		t.Error("mirrored to itself")
+	}
+	err = Mirror(mirrorOptions{To: "elsewhere"})
+	if err == nil || !strings.Contains(err.Error(), "no storage elsewhere") {
+		t.Errorf("unknown storage: %v", err)
+	}
+
+	// the endpoint settings stay at the top of pgbackup.conf
+	conf, _ := json.Marshal(&config)
+	if !strings.Contains(string(conf), `"endpoint":"`+config.Endpoint+`"`) || !strings.Contains(string(conf), `"storages":{"offsite":{"endpoint"`) {
+		t.Errorf("config %s", conf)
+	}
+}
+
+func TestMirrorWithoutStat(t *testing.T) {
+	b := startBackend(t)
+	off, s := serveTest(t, t.TempDir())
+	config.Storages = map[string]*storage{"offsite": &s}
+	var noStat string
+	serveStat = func(dir string) bool { return dir != noStat }
+	defer func() { serveStat = func(string) bool { return true } }()
+
+	files := []string{"0000000000000001.1.wal", "0000000000000002.1.wal", "0000000000000003.1.wal"}
+	for i, f := range files {
+		b.putEncrypted(f, bytes.Repeat([]byte{byte(i)}, 1000))
+		d, _ := b.file(f)
+		sum := sha256.Sum256(d)
+		ix := segmentIndex{Unindexed: true, Size: 1000, EncSha256: hex.EncodeToString(sum[:])}
+		if i == 2 {
+			ix = segmentIndex{Unindexed: true} // from before checksums
+		}
+		j, _ := json.Marshal(&ix)
+		b.putEncrypted(indexFile(uint64(i+1), 1), j)
+	}
+	old := time.Now().Add(-time.Hour)
+	reset := func() {
+		d, _ := b.file(files[0])
+		off.put(files[0], d)                             // the same
+		off.put(files[1], bytes.Repeat([]byte{9}, 1000)) // same size, other contents
+		off.put(files[2], bytes.Repeat([]byte{9}, 1000)) // the same, as far as the index tells
+		for _, f := range files {
+			os.Chtimes(filepath.Join(off.dir, f), old, old)
+		}
+	}
+	check := func(name string, copied ...bool) {
+		t.Helper()
+		for i, f := range files {
+			st, _ := os.Stat(filepath.Join(off.dir, f))
+			if c := st.ModTime().After(old.Add(time.Minute)); c != copied[i] {
+				t.Errorf("%s: %s copied %v", name, f, c)
+			}
+			want, _ := b.file(f)
+			if got, _ := off.file(f); copied[i] && !bytes.Equal(got, want) {
+				t.Errorf("%s: %s differs", name, f)
+			}
+		}
+	}
+
+	// the hosted backend has no pgbackup.stat, the sums are in the index
+	noStat = b.dir
+	for _, c := range []struct {
+		verify bool
+		copied []bool
+	}{
+		{false, []bool{false, true, false}},
+		{true, []bool{false, true, true}},
+	} {
+		reset()
+		err := Mirror(mirrorOptions{To: "offsite", Verify: c.verify})
+		if err != nil {
+			t.Fatal(err)
+		}
+		check(fmt.Sprintf("from, verify %v", c.verify), c.copied...)
+	}
+
+	// copying to it, objects there count as the same
+	noStat = off.dir
+	for _, c := range []struct {
+		verify bool
+		copied []bool
+	}{
+		{false, []bool{false, false, false}},
+		{true, []bool{false, true, true}},
+	} {
+		reset()
+		err := Mirror(mirrorOptions{To: "offsite", Verify: c.verify})
+		if err != nil {
+			t.Fatal(err)
+		}
+		check(fmt.Sprintf("to, verify %v", c.verify), c.copied...)
+	}
+}
+
+func TestMirrorDir(t *testing.T) {
+	b := startBackend(t)
+	dir := t.TempDir()
+	config.Storages = map[string]*storage{"files": {Dir: dir}}
+
+	var files []string
+	for i := 1; i <= 20; i++ {
+		f := walSegment{uint64(i), 1}.File()
+		b.putEncrypted(f, bytes.Repeat([]byte{byte(i)}, 100000))
+		b.putEncrypted(indexFile(uint64(i), 1), []byte(`{"unindexed":true}`))
+		files = append(files, f)
+	}
+	err := Mirror(mirrorOptions{To: "files"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range files {
+		want, _ := b.file(f)
+		if got, _ := ioutil.ReadFile(filepath.Join(dir, f)); !bytes.Equal(got, want) {
+			t.Errorf("%s: %d bytes, want %d", f, len(got), len(want))
+		}
+	}
+
+	// and back, comparing by pgbackup.stat on both sides
+	want, _ := b.file(files[3])
+	os.Remove(filepath.Join(b.dir, files[3]))
+	err = Mirror(mirrorOptions{From: "files"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := b.file(files[3]); !bytes.Equal(got, want) {
+		t.Errorf("%s not copied back", files[3])
+	}
+}
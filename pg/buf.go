@@ -3,7 +3,7 @@ package pg
 import (
 	"bytes"
 	"encoding/binary"
-	"log"
+	"log/slog"
 )
 
 type ReadBuf []byte
@@ -29,7 +29,7 @@ func (b *ReadBuf) Int64() int64 {
 func (b *ReadBuf) String() string {
 	i := bytes.IndexByte(*b, 0)
 	if i < 0 {
-		log.Print("pgrepl: no string terminator")
+		slog.Warn("pg: no string terminator")
 		return ""
 	}
 	s := (*b)[:i]
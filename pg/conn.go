@@ -9,7 +9,7 @@ import (
 	"errors"
 	"fmt"
 	"io"
-	"log"
+	"log/slog"
 	"net"
 	"strconv"
 	"strings"
@@ -24,6 +24,9 @@ type Conn struct {
 	conn net.Conn
 	rb   io.Reader
 
+	unrecvTag     byte // message pushed back by unrecv
+	unrecvPayload ReadBuf
+
 	ServerVersion string
 }
 
@@ -96,14 +99,22 @@ func NewConn(connString string) (*Conn, error) {
 			return nil, errProtocol
 		}
 	}
-
-	return c, nil
 }
 
 func (c *Conn) Close() {
 	c.conn.Close()
 }
 
+// ServerVersionNum returns the major version of the server, eg 9 or 15
+func (c *Conn) ServerVersionNum() int {
+	v := strings.FieldsFunc(c.ServerVersion, func(r rune) bool { return r < '0' || r > '9' })
+	if len(v) == 0 {
+		return 0
+	}
+	n, _ := strconv.Atoi(v[0])
+	return n
+}
+
 func (c *Conn) SimpleQuery(q string) ([][]interface{}, error) {
 
 	b := WriteBuf{}
@@ -134,7 +145,7 @@ func (c *Conn) processReady() error {
 		case 'Z': // ReadyForQuery
 			return nil
 		default:
-			log.Print("pg: processReady unknown tag=", string(tag))
+			slog.Warn("pg: processReady unknown tag", "tag", string(tag))
 			return errProtocol
 		}
 	}
@@ -155,7 +166,7 @@ func (c *Conn) processResult() ([][]interface{}, error) {
 			return nil, err
 		}
 
-		//log.Print("pg: pcr tag=", string(tag))
+		slog.Debug("pg: processResult", "tag", string(tag))
 
 		switch tag {
 		case 'T': // RowDescription
@@ -185,7 +196,7 @@ func (c *Conn) processResult() ([][]interface{}, error) {
 		case 'C': // CommandComplete
 			return rows, nil
 		default:
-			log.Print("pg: processResult unknown tag=", string(tag))
+			slog.Warn("pg: processResult unknown tag", "tag", string(tag))
 		}
 	}
 }
@@ -199,7 +210,17 @@ func (c *Conn) send(tag byte, payload WriteBuf) error {
 	return err
 }
 
+// unrecv pushes back a message, to be returned by the next recv
+func (c *Conn) unrecv(tag byte, payload ReadBuf) {
+	c.unrecvTag, c.unrecvPayload = tag, payload
+}
+
 func (c *Conn) recv() (byte, ReadBuf, error) {
+	if c.unrecvTag != 0 {
+		tag := c.unrecvTag
+		c.unrecvTag = 0
+		return tag, c.unrecvPayload, nil
+	}
 
 	var x [5]byte
 
@@ -222,7 +243,7 @@ func (c *Conn) recv() (byte, ReadBuf, error) {
 		case 'E': // ErrorResponse
 			return 0, nil, errors.New(errorResponseString(payload))
 		case 'N': // NoticeResponse
-			log.Print("pg: ", errorResponseString(payload))
+			slog.Info("pg: " + errorResponseString(payload))
 		default:
 			return tag, ReadBuf(payload), nil
 		}
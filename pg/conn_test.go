@@ -0,0 +1,61 @@
+package pg
+
+import (
+	"strings"
+	"testing"
+
+	"./pgtest"
+)
+
+func startServer(t *testing.T, s *pgtest.Server) *pgtest.Server {
+	t.Helper()
+	err := s.Start()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(s.Close)
+	return s
+}
+
+func TestNewConnAuth(t *testing.T) {
+	for _, auth := range []string{"trust", "password", "md5"} {
+		s := startServer(t, &pgtest.Server{Auth: auth, User: "backup", Password: "secret", Version: "10.5"})
+
+		c, err := NewConn(s.ConnString())
+		if err != nil {
+			t.Fatalf("%s: %s", auth, err)
+		}
+		if c.ServerVersion != "10.5" || c.ServerVersionNum() != 10 {
+			t.Errorf("%s: server version %q", auth, c.ServerVersion)
+		}
+		c.Close()
+
+		if auth == "trust" {
+			continue
+		}
+		_, err = NewConn(strings.Replace(s.ConnString(), "secret", "wrong", 1))
+		if err == nil || !strings.Contains(err.Error(), "password authentication failed") {
+			t.Errorf("%s: wrong password: %v", auth, err)
+		}
+	}
+}
+
+func TestSimpleQueryError(t *testing.T) {
+	s := startServer(t, &pgtest.Server{Errors: map[string]string{"SELECT": "relation does not exist"}})
+	c, err := NewConn(s.ConnString())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	_, err = c.SimpleQuery("SELECT 1")
+	if err == nil || err.Error() != "ERROR: relation does not exist" {
+		t.Errorf("error %v", err)
+	}
+
+	// the connection is still usable
+	_, _, _, err = c.IdentifySystem()
+	if err != nil {
+		t.Error(err)
+	}
+}
@@ -1,8 +1,10 @@
 package pg
 
 import (
+	"bytes"
 	"encoding/binary"
-	"log"
+	"encoding/hex"
+	"log/slog"
 	"strconv"
 )
 
@@ -28,7 +30,7 @@ func (c *Conn) decodeBinary(raw []byte, colType uint32, colFormat uint16) interf
 	case 21: // T_int2
 		return int64(int16(binary.BigEndian.Uint16(raw)))
 	default:
-		log.Print("pgrepl: can't decodeBinary colType=", colType)
+		slog.Warn("pg: can't decodeBinary", "colType", colType)
 	}
 	return nil
 }
@@ -37,11 +39,16 @@ func (c *Conn) decodeText(raw []byte, colType uint32, colFormat uint16) interfac
 	switch colType {
 	case 18, 1043, 25: // T_char, T_varchar, T_text
 		return string(raw)
-	case 17: // T_bytea
-		return "todo"
+	case 17: // T_bytea, hex escaped, or raw like TIMELINE_HISTORY sends it
+		if bytes.HasPrefix(raw, []byte(`\x`)) {
+			if d, err := hex.DecodeString(string(raw[2:])); err == nil {
+				return d
+			}
+		}
+		return raw
 	case 16: // T_bool
-		return raw[0] == 'T'
-	case 20, 23, 21: // T_int8, T_int4, T_int2
+		return raw[0] == 't'
+	case 20, 23, 21, 26: // T_int8, T_int4, T_int2, T_oid
 		i, _ := strconv.ParseInt(string(raw), 10, 64)
 		return i
 	case 700: // T_float4
@@ -51,7 +58,7 @@ func (c *Conn) decodeText(raw []byte, colType uint32, colFormat uint16) interfac
 		f, _ := strconv.ParseFloat(string(raw), 64)
 		return f
 	default:
-		log.Print("pgrepl: can't decodeText colType=", colType)
+		slog.Warn("pg: can't decodeText", "colType", colType)
 	}
 	return nil
 }
@@ -0,0 +1,568 @@
+// Package pgtest is a fake postgres server, speaking enough of the wire
+// and replication protocol to script the flows of package pg in tests:
+// startup and auth, IDENTIFY_SYSTEM, TIMELINE_HISTORY, START_REPLICATION
+// streaming synthetic wal, BASE_BACKUP and UPLOAD_MANIFEST.
+package pgtest
+
+import (
+	"bufio"
+	"crypto/md5"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Tablespace is an archive sent by BASE_BACKUP, Oid and Location are empty
+// for the data directory
+type Tablespace struct {
+	Oid      string
+	Location string
+	Tar      []byte
+}
+
+// Server is a fake postgres, set its fields before Start
+type Server struct {
+	Version  string // server_version, selects the BASE_BACKUP format, default "16.4"
+	SystemId uint64
+	Timeline int
+	History  map[int]string // timeline history files, by timeline
+
+	Auth     string // "trust" (default), "password" or "md5"
+	User     string
+	Password string
+
+	WALStart uint64 // wal is available from here
+	WALEnd   uint64 // the current position, streaming stops here
+	Chunk    int    // bytes per XLogData message, default 128kB
+
+	RemovedBefore uint64 // START_REPLICATION before this fails like postgres does
+
+	Tablespaces []Tablespace // the data directory goes last, like postgres sends it
+	Manifest    []byte       // sent with MANIFEST 'yes'
+	BackupStart uint64
+	BackupEnd   uint64
+
+	Errors map[string]string // queries starting with a key fail with its message
+
+	Addr string // set by Start
+
+	mu       sync.Mutex
+	queries  []string
+	manifest []byte // uploaded with UPLOAD_MANIFEST
+	l        net.Listener
+	wg       sync.WaitGroup
+}
+
+// Start listens on a random local port
+func (s *Server) Start() error {
+	if s.Version == "" {
+		s.Version = "16.4"
+	}
+	if s.Timeline == 0 {
+		s.Timeline = 1
+	}
+	if s.Chunk == 0 {
+		s.Chunk = 128 << 10
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return err
+	}
+	s.l = l
+	s.Addr = l.Addr().String()
+
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			s.wg.Add(1)
+			go func() {
+				defer s.wg.Done()
+				defer c.Close()
+				s.serve(c)
+			}()
+		}
+	}()
+	return nil
+}
+
+// ConnString returns the options to connect to s with package pg
+func (s *Server) ConnString() string {
+	host, port, _ := net.SplitHostPort(s.Addr)
+	cs := fmt.Sprintf("host=%s port=%s", host, port)
+	if s.User != "" {
+		cs += " user=" + s.User
+	}
+	if s.Password != "" {
+		cs += " password=" + s.Password
+	}
+	return cs
+}
+
+// Close stops listening and waits for all connections to end
+func (s *Server) Close() {
+	s.l.Close()
+	s.wg.Wait()
+}
+
+// Queries returns the queries received so far
+func (s *Server) Queries() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.queries...)
+}
+
+// UploadedManifest returns what was sent with UPLOAD_MANIFEST
+func (s *Server) UploadedManifest() []byte {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.manifest
+}
+
+// WAL returns the synthetic wal the server streams from lsn
+func WAL(lsn uint64, n int) []byte {
+	d := make([]byte, n)
+	for i := range d {
+		x := lsn + uint64(i)
+		d[i] = byte(x ^ x>>8 ^ x>>16 ^ x>>24)
+	}
+	return d
+}
+
+var errClosed = errors.New("connection closed")
+
+type conn struct {
+	s  *Server
+	c  net.Conn
+	rb *bufio.Reader
+}
+
+func (s *Server) serve(nc net.Conn) {
+	c := &conn{s: s, c: nc, rb: bufio.NewReader(nc)}
+	params, err := c.startup()
+	if err != nil {
+		return
+	}
+	if !c.auth(params["user"]) {
+		return
+	}
+
+	c.send('S', str("server_version")+str(s.Version))
+	c.send('K', int32s(1234, 5678))
+	c.ready()
+
+	for {
+		tag, payload, err := c.recv()
+		if err != nil {
+			return
+		}
+		switch tag {
+		case 'Q':
+			q := strings.TrimRight(string(payload), "\x00")
+			s.mu.Lock()
+			s.queries = append(s.queries, q)
+			s.mu.Unlock()
+			if c.query(q) != nil {
+				return
+			}
+		case 'X': // Terminate
+			return
+		default:
+			c.error("08P01", fmt.Sprintf("unexpected message %c", tag))
+			return
+		}
+	}
+}
+
+func (c *conn) startup() (map[string]string, error) {
+	for {
+		var x [4]byte
+		_, err := io.ReadFull(c.rb, x[:])
+		if err != nil {
+			return nil, err
+		}
+		d := make([]byte, binary.BigEndian.Uint32(x[:])-4)
+		_, err = io.ReadFull(c.rb, d)
+		if err != nil {
+			return nil, err
+		}
+		if len(d) < 4 {
+			return nil, errClosed
+		}
+		switch binary.BigEndian.Uint32(d) {
+		case 80877103: // SSLRequest
+			c.c.Write([]byte{'N'})
+			continue
+		case 196608: // protocol 3.0
+		default:
+			return nil, fmt.Errorf("unsupported protocol %d", binary.BigEndian.Uint32(d))
+		}
+		params := map[string]string{}
+		kv := strings.Split(string(d[4:]), "\x00")
+		for i := 0; i+1 < len(kv); i += 2 {
+			params[kv[i]] = kv[i+1]
+		}
+		return params, nil
+	}
+}
+
+func (c *conn) auth(user string) bool {
+	s := c.s
+	if s.User != "" && user != s.User {
+		c.error("28000", fmt.Sprintf(`role "%s" does not exist`, user))
+		return false
+	}
+
+	var want string
+	switch s.Auth {
+	case "", "trust":
+		c.send('R', int32s(0))
+		return true
+	case "password":
+		c.send('R', int32s(3))
+		want = s.Password
+	case "md5":
+		salt := "salt"
+		c.send('R', int32s(5)+salt)
+		want = "md5" + md5sum(md5sum(s.Password+user)+salt)
+	}
+
+	tag, payload, err := c.recv()
+	if err != nil || tag != 'p' || strings.TrimRight(string(payload), "\x00") != want {
+		c.error("28P01", fmt.Sprintf(`password authentication failed for user "%s"`, user))
+		return false
+	}
+	c.send('R', int32s(0))
+	return true
+}
+
+func (c *conn) query(q string) error {
+	s := c.s
+	for prefix, msg := range s.Errors {
+		if strings.HasPrefix(q, prefix) {
+			c.error("XX000", msg)
+			return c.ready()
+		}
+	}
+
+	cmd := strings.Fields(q)
+	if len(cmd) == 0 {
+		c.send('I', "") // EmptyQueryResponse
+		return c.ready()
+	}
+	switch strings.ToUpper(cmd[0]) {
+	case "IDENTIFY_SYSTEM":
+		c.rowDescription([]string{"systemid", "timeline", "xlogpos", "dbname"}, []int32{25, 23, 25, 25})
+		c.dataRow(strconv.FormatUint(s.SystemId, 10), strconv.Itoa(s.Timeline), lsn(s.WALEnd), nil)
+		c.complete("IDENTIFY_SYSTEM")
+	case "TIMELINE_HISTORY":
+		tl, _ := strconv.Atoi(cmd[len(cmd)-1])
+		h, ok := s.History[tl]
+		if !ok {
+			c.error("58P01", fmt.Sprintf(`could not open file "pg_wal/%08X.history"`, tl))
+			break
+		}
+		c.rowDescription([]string{"filename", "content"}, []int32{25, 17})
+		c.dataRow(fmt.Sprintf("%08X.history", tl), h)
+		c.complete("TIMELINE_HISTORY")
+	case "START_REPLICATION":
+		return c.startReplication(cmd)
+	case "BASE_BACKUP":
+		return c.baseBackup(q)
+	case "UPLOAD_MANIFEST":
+		return c.uploadManifest()
+	default:
+		c.error("42601", fmt.Sprintf(`syntax error at or near "%s"`, cmd[0]))
+	}
+	return c.ready()
+}
+
+func (c *conn) startReplication(cmd []string) error {
+	s := c.s
+	var start uint64
+	for _, a := range cmd[1:] {
+		if l, ok := parseLsn(a); ok {
+			start = l
+		}
+	}
+
+	c.send('W', "\x00"+int16s(0)) // CopyBothResponse
+	if start < s.RemovedBefore || start < s.WALStart&^0xffffff {
+		c.error("58P01", fmt.Sprintf("requested WAL segment %08X%08X%08X has already been removed", s.Timeline, start>>32, start>>24&0xff))
+		return c.ready()
+	}
+
+	// standby status updates, we only want to know how far the client is
+	replies := make(chan uint64, 16)
+	go func() {
+		defer close(replies)
+		for {
+			tag, payload, err := c.recv()
+			if err != nil || tag != 'd' {
+				return
+			}
+			if len(payload) >= 9 && payload[0] == 'r' {
+				select {
+				case replies <- binary.BigEndian.Uint64(payload[1:]):
+				default:
+				}
+			}
+		}
+	}()
+
+	var n int
+	var last uint64
+	for l := start; l < s.WALEnd; {
+		size := s.Chunk
+		if next := (l | 0xffffff) + 1; l+uint64(size) > next {
+			size = int(next - l) // messages don't span segments, like postgres
+		}
+		if l+uint64(size) > s.WALEnd {
+			size = int(s.WALEnd - l)
+		}
+		err := c.send('d', "w"+int64s(l, s.WALEnd, 0)+string(WAL(l, size)))
+		if err != nil {
+			return err
+		}
+		last = l
+		l += uint64(size)
+		if n++; n%16 == 0 {
+			c.keepalive(false)
+		}
+	}
+
+	// wait for the client to have seen everything before hanging up
+	c.keepalive(true)
+	timeout := time.After(10 * time.Second)
+	for {
+		select {
+		case r, ok := <-replies:
+			if !ok || r >= last {
+				return errClosed
+			}
+		case <-timeout:
+			return errClosed
+		}
+	}
+}
+
+func (c *conn) keepalive(reply bool) error {
+	r := "\x00"
+	if reply {
+		r = "\x01"
+	}
+	return c.send('d', "k"+int64s(c.s.WALEnd, 0)+r)
+}
+
+func (c *conn) baseBackup(q string) error {
+	s := c.s
+	manifest := strings.Contains(q, "MANIFEST 'yes'") && s.Manifest != nil
+
+	c.rowDescription([]string{"recptr", "tli"}, []int32{25, 20})
+	c.dataRow(lsn(s.BackupStart), strconv.Itoa(s.Timeline))
+	c.complete("SELECT")
+
+	c.rowDescription([]string{"spcoid", "spclocation", "size"}, []int32{26, 25, 20})
+	for _, ts := range s.Tablespaces {
+		var oid, location interface{}
+		if ts.Oid != "" {
+			oid, location = ts.Oid, ts.Location
+		}
+		var size interface{}
+		if strings.Contains(q, "PROGRESS") {
+			size = strconv.Itoa((len(ts.Tar) + 1023) / 1024)
+		}
+		c.dataRow(oid, location, size)
+	}
+	c.complete("SELECT")
+
+	major, _ := strconv.Atoi(strings.SplitN(s.Version, ".", 2)[0])
+	if major >= 15 {
+		// one CopyOut, multiplexing the archives by a type byte
+		c.send('H', "\x00"+int16s(0))
+		for _, ts := range s.Tablespaces {
+			name := "base.tar"
+			if ts.Oid != "" {
+				name = ts.Oid + ".tar"
+			}
+			c.send('d', "n"+str(name)+str(ts.Location))
+			for _, d := range chunks(ts.Tar, s.Chunk) {
+				c.send('d', "d"+string(d))
+			}
+			c.send('d', "p"+int64s(uint64(len(ts.Tar))))
+		}
+		if manifest {
+			c.send('d', "m")
+			for _, d := range chunks(s.Manifest, s.Chunk) {
+				c.send('d', "d"+string(d))
+			}
+		}
+		c.send('c', "")
+	} else {
+		// a CopyOut per archive, and one for the manifest
+		archives := [][]byte{}
+		for _, ts := range s.Tablespaces {
+			archives = append(archives, ts.Tar)
+		}
+		if manifest {
+			archives = append(archives, s.Manifest)
+		}
+		for _, a := range archives {
+			c.send('H', "\x00"+int16s(0))
+			for _, d := range chunks(a, s.Chunk) {
+				c.send('d', string(d))
+			}
+			c.send('c', "")
+		}
+	}
+
+	c.rowDescription([]string{"recptr", "tli"}, []int32{25, 20})
+	c.dataRow(lsn(s.BackupEnd), strconv.Itoa(s.Timeline))
+	c.complete("SELECT")
+	c.complete("BASE_BACKUP")
+	return c.ready()
+}
+
+func (c *conn) uploadManifest() error {
+	c.send('G', "\x00"+int16s(0)) // CopyInResponse
+	var m []byte
+	for {
+		tag, payload, err := c.recv()
+		if err != nil {
+			return err
+		}
+		if tag == 'c' {
+			break
+		}
+		if tag != 'd' {
+			c.error("08P01", "expected CopyData")
+			return c.ready()
+		}
+		m = append(m, payload...)
+	}
+	c.s.mu.Lock()
+	c.s.manifest = m
+	c.s.mu.Unlock()
+	c.complete("UPLOAD_MANIFEST")
+	return c.ready()
+}
+
+func (c *conn) send(tag byte, payload string) error {
+	d := make([]byte, 5, 5+len(payload))
+	d[0] = tag
+	binary.BigEndian.PutUint32(d[1:], uint32(len(payload)+4))
+	_, err := c.c.Write(append(d, payload...))
+	return err
+}
+
+func (c *conn) recv() (byte, []byte, error) {
+	var x [5]byte
+	_, err := io.ReadFull(c.rb, x[:])
+	if err != nil {
+		return 0, nil, err
+	}
+	d := make([]byte, binary.BigEndian.Uint32(x[1:])-4)
+	_, err = io.ReadFull(c.rb, d)
+	return x[0], d, err
+}
+
+func (c *conn) ready() error {
+	return c.send('Z', "I")
+}
+
+func (c *conn) error(code, msg string) error {
+	return c.send('E', "SERROR\x00C"+code+"\x00M"+msg+"\x00\x00")
+}
+
+func (c *conn) complete(tag string) error {
+	return c.send('C', str(tag))
+}
+
+func (c *conn) rowDescription(names []string, types []int32) error {
+	p := int16s(len(names))
+	for i, n := range names {
+		p += str(n) + int32s(0) + int16s(0) + int32s(int(types[i])) + int16s(-1) + int32s(-1) + int16s(0)
+	}
+	return c.send('T', p)
+}
+
+// dataRow sends string values, nil for NULL
+func (c *conn) dataRow(values ...interface{}) error {
+	p := int16s(len(values))
+	for _, v := range values {
+		if s, ok := v.(string); ok {
+			p += int32s(len(s)) + s
+		} else {
+			p += int32s(-1)
+		}
+	}
+	return c.send('D', p)
+}
+
+func chunks(d []byte, n int) [][]byte {
+	var r [][]byte
+	for len(d) > n {
+		r = append(r, d[:n])
+		d = d[n:]
+	}
+	if len(d) > 0 {
+		r = append(r, d)
+	}
+	return r
+}
+
+func str(s string) string {
+	return s + "\x00"
+}
+
+func int16s(vs ...int) string {
+	var b []byte
+	for _, v := range vs {
+		b = binary.BigEndian.AppendUint16(b, uint16(v))
+	}
+	return string(b)
+}
+
+func int32s(vs ...int) string {
+	var b []byte
+	for _, v := range vs {
+		b = binary.BigEndian.AppendUint32(b, uint32(v))
+	}
+	return string(b)
+}
+
+func int64s(vs ...uint64) string {
+	var b []byte
+	for _, v := range vs {
+		b = binary.BigEndian.AppendUint64(b, v)
+	}
+	return string(b)
+}
+
+func lsn(l uint64) string {
+	return fmt.Sprintf("%X/%X", l>>32, uint32(l))
+}
+
+func parseLsn(s string) (uint64, bool) {
+	p := strings.Split(s, "/")
+	if len(p) != 2 {
+		return 0, false
+	}
+	hi, err1 := strconv.ParseUint(p[0], 16, 32)
+	lo, err2 := strconv.ParseUint(p[1], 16, 32)
+	return hi<<32 | lo, err1 == nil && err2 == nil
+}
+
+func md5sum(s string) string {
+	return fmt.Sprintf("%x", md5.Sum([]byte(s)))
+}
@@ -1,7 +1,8 @@
 package pg
 
 import (
-	"log"
+	"fmt"
+	"log/slog"
 	"strconv"
 	"strings"
 	"time"
@@ -26,11 +27,34 @@ func (c *Conn) IdentifySystem() (uint64, int, string, error) {
 	return uint64(systemID0), int(timeline), lsn, nil
 }
 
+// TimelineHistory returns the name and contents of the history file of a
+// timeline
+func (c *Conn) TimelineHistory(timeline int) (string, []byte, error) {
+	rows, err := c.SimpleQuery(fmt.Sprintf("TIMELINE_HISTORY %d", timeline))
+	if err != nil {
+		return "", nil, err
+	}
+
+	if len(rows) != 1 || len(rows[0]) != 2 {
+		return "", nil, errProtocol
+	}
+
+	name, _ := rows[0][0].(string)
+	switch content := rows[0][1].(type) {
+	case []byte:
+		return name, content, nil
+	case string:
+		return name, []byte(content), nil
+	}
+	return "", nil, errProtocol
+}
+
 type WALData struct {
 	Lsn        uint64
 	ServerLsn  uint64
 	ServerTime time.Time
 	Data       []byte
+	Keepalive  bool // no Data, just the server position
 }
 
 // https://www.postgresql.org/docs/9.5/static/protocol-replication.html
@@ -48,7 +72,7 @@ func (c *Conn) StartReplication(q string) (<-chan WALData, error) {
 			// CopyBothResponse
 			break
 		}
-		log.Print("pg: StartReplication unknown tag=", string(tag))
+		slog.Warn("pg: StartReplication unknown tag", "tag", string(tag))
 	}
 
 	walC := make(chan WALData)
@@ -59,7 +83,7 @@ func (c *Conn) StartReplication(q string) (<-chan WALData, error) {
 		for {
 			tag, payload, err := c.recv()
 			if err != nil {
-				log.Print("pg: replication err=", err)
+				slog.Warn("pg: replication failed", "err", err)
 				if strings.Contains(err.Error(), "already been removed") {
 					walC <- WALData{} // indicates missing wal segment
 				}
@@ -76,14 +100,19 @@ func (c *Conn) StartReplication(q string) (<-chan WALData, error) {
 					var p WALData
 					p.Lsn = uint64(b.Int64())
 					p.ServerLsn = uint64(b.Int64())
-					p.ServerTime = time.Unix(0, b.Int64()*1000000)
+					p.ServerTime = pgTime(b.Int64())
 					p.Data = []byte(b)
-					//log.Print("walData! tag=", tag, " lsn=", p.Lsn, " serverLsn=", p.ServerLsn, " data=", len(p.Data))
+					slog.Debug("pg: wal data", "lsn", p.Lsn, "serverLsn", p.ServerLsn, "bytes", len(p.Data))
 					walC <- p
 					// TODO: queue locally if sending would block, we'd need flow control on the channel
 					clientLsn = p.Lsn
 				case 'k':
-					//log.Print("pg: ping received")
+					slog.Debug("pg: keepalive received")
+					var p WALData
+					p.Keepalive = true
+					p.ServerLsn = uint64(b.Int64())
+					p.ServerTime = pgTime(b.Int64())
+
 					b := WriteBuf{}
 					b.Byte('r')
 					b.Int64(int64(clientLsn))
@@ -92,72 +121,243 @@ func (c *Conn) StartReplication(q string) (<-chan WALData, error) {
 					b.Int64(pgEpoch())
 					b.Byte(0)
 					c.send('d', b)
+
+					walC <- p
 				}
 			default:
-				log.Print("pg: StartReplication unknown tag=", string(tag))
+				slog.Warn("pg: StartReplication unknown tag", "tag", string(tag))
 			}
 		}
 	}()
 	return walC, nil
 }
 
+// pgTime converts microseconds since Jan 1, 2000 to a time.Time
+func pgTime(us int64) time.Time {
+	return time.Date(2000, time.January, 1, 0, 0, 0, 0, time.UTC).Add(time.Duration(us) * time.Microsecond)
+}
+
 // pgEpoch returns microseconds since Jan 1, 2000
 func pgEpoch() int64 {
 	return time.Since(time.Date(2000, time.January, 1, 0, 0, 0, 0, time.UTC)).Nanoseconds() / 1000
 }
 
-func (c *Conn) BaseBackup(q string) (int, string, <-chan []byte, error) {
+// Tablespace is a row of the tablespace result set of BASE_BACKUP, Oid and
+// Location are empty for the main data directory
+type Tablespace struct {
+	Oid      string
+	Location string
+	Size     int64 // in kB, only estimated with PROGRESS
+}
+
+// BackupChunk is a piece of the tar archive of Tablespace, or of the
+// backup manifest if Tablespace is nil
+type BackupChunk struct {
+	Tablespace *Tablespace
+	Data       []byte
+}
+
+// Backup is a running base backup, its archives are sent one after the
+// other over the Data channel
+type Backup struct {
+	StartLsn    string
+	Timeline    int
+	Tablespaces []Tablespace
+	Data        <-chan BackupChunk
+
+	// set once Data is closed
+	Err         error
+	EndLsn      string
+	EndTimeline int
+}
+
+func (c *Conn) BaseBackup(q string) (*Backup, error) {
 	b := WriteBuf{}
 	b.String(q)
 	c.send('Q', b)
 
 	rows, err := c.processResult()
 	if err != nil {
-		return 0, "", nil, err
+		return nil, err
 	}
 	if len(rows) != 1 || len(rows[0]) != 2 {
-		return 0, "", nil, errProtocol
+		return nil, errProtocol
 	}
-	startLsn := rows[0][0].(string)
-	timeline := rows[0][1].(int64)
+	bb := &Backup{}
+	bb.StartLsn, _ = rows[0][0].(string)
+	timeline, _ := rows[0][1].(int64)
+	bb.Timeline = int(timeline)
 
 	rows, err = c.processResult()
 	if err != nil {
-		return 0, "", nil, err
+		return nil, err
+	}
+	slog.Debug("pg: BaseBackup tablespaces", "rows", rows)
+	for _, row := range rows {
+		if len(row) < 2 {
+			return nil, errProtocol
+		}
+		var ts Tablespace
+		if oid, ok := row[0].(int64); ok {
+			ts.Oid = strconv.FormatInt(oid, 10)
+		}
+		ts.Location, _ = row[1].(string)
+		if len(row) > 2 {
+			ts.Size, _ = row[2].(int64)
+		}
+		bb.Tablespaces = append(bb.Tablespaces, ts)
 	}
-	//log.Print("tblMappingRow=", rows)
 
-	bbC := make(chan []byte)
+	bbC := make(chan BackupChunk)
+	bb.Data = bbC
 	go func() {
-		done := false
-		for !done {
-			tag, payload, err := c.recv()
-			if err != nil {
-				log.Print("pg: BaseBackup err=", err)
-				close(bbC)
-				return
-			}
+		defer close(bbC)
+		if c.ServerVersionNum() >= 15 {
+			bb.Err = c.copyStream(bb, bbC)
+		} else {
+			bb.Err = c.copyTablespaces(bb, bbC)
+		}
+		if bb.Err != nil {
+			slog.Warn("pg: BaseBackup failed", "err", bb.Err)
+			return
+		}
 
-			switch tag {
-			case 'H': // CopyOutResponse
-			case 'd': // CopyData
-				bbC <- payload
-			case 'c': // CopyDone
-				done = true
-			default:
-				log.Print("pg: BaseBackup unknown tag=", string(tag))
+		rows, err := c.processResult()
+		if err == nil && (len(rows) != 1 || len(rows[0]) != 2) {
+			err = errProtocol
+		}
+		if err != nil {
+			bb.Err = err
+			return
+		}
+		slog.Debug("pg: BaseBackup end", "row", rows[0])
+		bb.EndLsn, _ = rows[0][0].(string)
+		timeline, _ := rows[0][1].(int64)
+		bb.EndTimeline = int(timeline)
+
+		c.processResult() // TODO: not sure why/if this is necessary
+	}()
+
+	return bb, nil
+}
+
+// copyTablespaces reads the pre-15 format: a CopyOut stream per tablespace,
+// in the order of the tablespace result set
+func (c *Conn) copyTablespaces(bb *Backup, bbC chan<- BackupChunk) error {
+	n := -1
+	for {
+		tag, payload, err := c.recv()
+		if err != nil {
+			return err
+		}
+
+		switch tag {
+		case 'H': // CopyOutResponse, the one after the tablespaces is the manifest
+			n++
+			if n > len(bb.Tablespaces) {
+				return errProtocol
 			}
+		case 'd': // CopyData
+			if n < 0 {
+				return errProtocol
+			}
+			var ts *Tablespace
+			if n < len(bb.Tablespaces) {
+				ts = &bb.Tablespaces[n]
+			}
+			bbC <- BackupChunk{Tablespace: ts, Data: payload}
+		case 'c': // CopyDone
+		case 'T': // RowDescription of the end position
+			c.unrecv(tag, payload)
+			return nil
+		default:
+			slog.Warn("pg: BaseBackup unknown tag", "tag", string(tag))
 		}
+	}
+}
 
-		rows, _ := c.processResult()
-		log.Print("pg: BaseBackup end=", rows[0])
+// copyStream reads the 15+ format: a single CopyOut stream, in which every
+// CopyData starts with a type byte
+func (c *Conn) copyStream(bb *Backup, bbC chan<- BackupChunk) error {
+	var ts *Tablespace
+	var manifest bool
+	for {
+		tag, payload, err := c.recv()
+		if err != nil {
+			return err
+		}
 
-		c.processResult() // TODO: not sure why/if this is necessary
+		switch tag {
+		case 'H': // CopyOutResponse
+		case 'd': // CopyData
+			switch payload.Byte() {
+			case 'n': // new archive
+				name := payload.String()
+				location := payload.String()
+				ts, manifest = nil, false
+				for i := range bb.Tablespaces {
+					if bb.Tablespaces[i].Location == location {
+						ts = &bb.Tablespaces[i]
+					}
+				}
+				if ts == nil {
+					return fmt.Errorf("pg: BaseBackup unknown archive %s", name)
+				}
+			case 'd': // archive or manifest data
+				if ts == nil && !manifest {
+					return errProtocol
+				}
+				bbC <- BackupChunk{Tablespace: ts, Data: payload}
+			case 'p': // progress
+			case 'm': // manifest
+				ts, manifest = nil, true
+			}
+		case 'c': // CopyDone
+			return nil
+		default:
+			slog.Warn("pg: BaseBackup unknown tag", "tag", string(tag))
+		}
+	}
+}
 
-		bbC <- nil // indicates success
+// UploadManifest sends the backup_manifest of an earlier backup, which a
+// following BASE_BACKUP (INCREMENTAL) on this connection is relative to
+func (c *Conn) UploadManifest(manifest []byte) error {
+	b := WriteBuf{}
+	b.String("UPLOAD_MANIFEST")
+	c.send('Q', b)
 
-		close(bbC)
-	}()
+	tag, _, err := c.recv()
+	if err != nil {
+		c.processReady()
+		return err
+	}
+	if tag != 'G' { // CopyInResponse
+		return errProtocol
+	}
+
+	for len(manifest) > 0 {
+		n := len(manifest)
+		if n > 65536 {
+			n = 65536
+		}
+		b := WriteBuf{}
+		b.Bytes(manifest[:n])
+		err = c.send('d', b) // CopyData
+		if err != nil {
+			return err
+		}
+		manifest = manifest[n:]
+	}
+	err = c.send('c', WriteBuf{}) // CopyDone
+	if err != nil {
+		return err
+	}
 
-	return int(timeline), startLsn, bbC, nil
+	_, err = c.processResult()
+	if err != nil {
+		c.processReady()
+		return err
+	}
+	return c.processReady()
 }
@@ -0,0 +1,163 @@
+package pg
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"./pgtest"
+)
+
+func TestIdentifySystem(t *testing.T) {
+	s := startServer(t, &pgtest.Server{SystemId: 6500000000000000001, Timeline: 3, WALEnd: 0x1_2345_6789})
+	c, err := NewConn(s.ConnString() + " replication=true")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	systemId, timeline, lsn, err := c.IdentifySystem()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if systemId != 6500000000000000001 || timeline != 3 || lsn != "1/23456789" {
+		t.Errorf("got %d %d %s", systemId, timeline, lsn)
+	}
+}
+
+func TestStartReplication(t *testing.T) {
+	s := startServer(t, &pgtest.Server{WALEnd: 0x2100000, Chunk: 1 << 16})
+	c, err := NewConn(s.ConnString() + " replication=true")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	walC, err := c.StartReplication("START_REPLICATION 0/1000000")
+	if err != nil {
+		t.Fatal(err)
+	}
+	next := uint64(0x1000000)
+	var keepalives int
+	for d := range walC {
+		if d.Keepalive {
+			keepalives++
+			if d.ServerLsn != 0x2100000 {
+				t.Errorf("keepalive server lsn %x", d.ServerLsn)
+			}
+			continue
+		}
+		if d.Lsn != next {
+			t.Fatalf("data at %x, expected %x", d.Lsn, next)
+		}
+		if !bytes.Equal(d.Data, pgtest.WAL(d.Lsn, len(d.Data))) {
+			t.Fatalf("wrong data at %x", d.Lsn)
+		}
+		next += uint64(len(d.Data))
+	}
+	if next != 0x2100000 {
+		t.Errorf("stream ended at %x", next)
+	}
+	if keepalives == 0 {
+		t.Error("no keepalives")
+	}
+}
+
+func TestStartReplicationRemoved(t *testing.T) {
+	s := startServer(t, &pgtest.Server{WALEnd: 0x5000000, RemovedBefore: 0x3000000})
+	c, err := NewConn(s.ConnString() + " replication=true")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	walC, err := c.StartReplication("START_REPLICATION 0/1000000")
+	if err != nil {
+		t.Fatal(err)
+	}
+	d, ok := <-walC
+	if !ok || d.Lsn != 0 || d.Keepalive {
+		t.Errorf("expected missing segment, got %v %+v", ok, d)
+	}
+	if _, ok := <-walC; ok {
+		t.Error("expected end of stream")
+	}
+}
+
+func TestBaseBackup(t *testing.T) {
+	for _, version := range []string{"14.9", "16.4"} {
+		s := startServer(t, &pgtest.Server{
+			Version:     version,
+			Timeline:    2,
+			BackupStart: 0x3000028,
+			BackupEnd:   0x3000138,
+			Chunk:       1000,
+			Tablespaces: []pgtest.Tablespace{
+				{Oid: "16400", Location: "/srv/ts", Tar: bytes.Repeat([]byte("t"), 2500)},
+				{Tar: bytes.Repeat([]byte("b"), 3000)},
+			},
+			Manifest: []byte(`{"PostgreSQL-Backup-Manifest-Version": 1}`),
+		})
+		c, err := NewConn(s.ConnString() + " replication=true")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c.Close()
+
+		bb, err := c.BaseBackup("BASE_BACKUP LABEL 'x' PROGRESS NOWAIT MANIFEST 'yes'")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if bb.StartLsn != "0/3000028" || bb.Timeline != 2 || len(bb.Tablespaces) != 2 {
+			t.Fatalf("%s: %+v", version, bb)
+		}
+		if ts := bb.Tablespaces[0]; ts.Oid != "16400" || ts.Location != "/srv/ts" || ts.Size != 3 {
+			t.Errorf("%s: tablespace %+v", version, ts)
+		}
+		if ts := bb.Tablespaces[1]; ts.Oid != "" || ts.Location != "" {
+			t.Errorf("%s: data directory %+v", version, ts)
+		}
+
+		archives := map[string]string{}
+		for d := range bb.Data {
+			name := "manifest"
+			if d.Tablespace != nil {
+				name = d.Tablespace.Oid
+			}
+			archives[name] += string(d.Data)
+		}
+		if bb.Err != nil {
+			t.Fatalf("%s: %s", version, bb.Err)
+		}
+		if archives["16400"] != strings.Repeat("t", 2500) || archives[""] != strings.Repeat("b", 3000) || archives["manifest"] != string(s.Manifest) {
+			t.Errorf("%s: archives %d %d %q", version, len(archives["16400"]), len(archives[""]), archives["manifest"])
+		}
+		if bb.EndLsn != "0/3000138" || bb.EndTimeline != 2 {
+			t.Errorf("%s: end %s %d", version, bb.EndLsn, bb.EndTimeline)
+		}
+	}
+}
+
+func TestUploadManifest(t *testing.T) {
+	s := startServer(t, &pgtest.Server{Version: "17.0"})
+	c, err := NewConn(s.ConnString() + " replication=true")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	m := bytes.Repeat([]byte("manifest "), 20000)
+	err = c.UploadManifest(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(s.UploadedManifest(), m) {
+		t.Errorf("uploaded %d bytes, expected %d", len(s.UploadedManifest()), len(m))
+	}
+
+	// ready for the next command
+	_, _, _, err = c.IdentifySystem()
+	if err != nil {
+		t.Error(err)
+	}
+}
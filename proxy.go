@@ -0,0 +1,180 @@
+package main
+
+// connects to the backend through an http (CONNECT) or socks5 proxy
+
+import (
+	"bufio"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+const dialTimeout = 30 * time.Second
+
+// dialBackend connects to addr, through proxy if set
+func dialBackend(proxy, addr string) (net.Conn, error) {
+	if proxy == "" {
+		return net.DialTimeout("tcp", addr, dialTimeout)
+	}
+	u, err := url.Parse(proxy)
+	if err != nil {
+		return nil, err
+	}
+	if u.Host == "" {
+		return nil, fmt.Errorf("proxy %s: no host, use eg http://proxy:3128 or socks5://proxy:1080", proxy)
+	}
+
+	c, err := net.DialTimeout("tcp", u.Host, dialTimeout)
+	if err != nil {
+		return nil, err
+	}
+	c.SetDeadline(time.Now().Add(dialTimeout))
+	switch u.Scheme {
+	case "http":
+		err = httpConnect(c, u, addr)
+	case "socks5", "socks5h":
+		err = socks5Connect(c, u, addr)
+	default:
+		err = fmt.Errorf("proxy scheme %s not supported, use http or socks5", u.Scheme)
+	}
+	if err != nil {
+		c.Close()
+		return nil, fmt.Errorf("proxy %s: %s", u.Host, err)
+	}
+	c.SetDeadline(time.Time{})
+	return c, nil
+}
+
+func httpConnect(c net.Conn, u *url.URL, addr string) error {
+	req := "CONNECT " + addr + " HTTP/1.1\r\nHost: " + addr + "\r\n"
+	if u.User != nil {
+		pass, _ := u.User.Password()
+		req += "Proxy-Authorization: Basic " + base64.StdEncoding.EncodeToString([]byte(u.User.Username()+":"+pass)) + "\r\n"
+	}
+	_, err := io.WriteString(c, req+"\r\n")
+	if err != nil {
+		return err
+	}
+
+	// read byte-for-byte, the tls handshake follows right after the response
+	rd := bufio.NewReaderSize(byteReader{c}, 16)
+	resp, err := http.ReadResponse(rd, nil)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != 200 {
+		return errors.New("CONNECT: " + resp.Status)
+	}
+	return nil
+}
+
+// byteReader reads one byte at a time, so nothing gets buffered
+type byteReader struct {
+	r io.Reader
+}
+
+func (b byteReader) Read(p []byte) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+	return b.r.Read(p[:1])
+}
+
+// socks5Connect does RFC 1928, with RFC 1929 username/password auth if the
+// url has them. The proxy resolves the host.
+func socks5Connect(c net.Conn, u *url.URL, addr string) error {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return err
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil || len(host) > 255 {
+		return errors.New("invalid address " + addr)
+	}
+
+	method := byte(0x00) // no auth
+	if u.User != nil {
+		method = 0x02
+	}
+	_, err = c.Write([]byte{5, 1, method})
+	if err != nil {
+		return err
+	}
+	var rep [2]byte
+	_, err = io.ReadFull(c, rep[:])
+	if err != nil {
+		return err
+	}
+	if rep[0] != 5 || rep[1] != method {
+		return errors.New("socks5: authentication method not accepted")
+	}
+
+	if u.User != nil {
+		user := u.User.Username()
+		pass, _ := u.User.Password()
+		if len(user) > 255 || len(pass) > 255 {
+			return errors.New("socks5: username or password too long")
+		}
+		req := append([]byte{1, byte(len(user))}, user...)
+		req = append(append(req, byte(len(pass))), pass...)
+		_, err = c.Write(req)
+		if err != nil {
+			return err
+		}
+		_, err = io.ReadFull(c, rep[:])
+		if err != nil {
+			return err
+		}
+		if rep[1] != 0 {
+			return errors.New("socks5: authentication failed")
+		}
+	}
+
+	req := []byte{5, 1, 0} // CONNECT
+	if ip := net.ParseIP(host); ip != nil && ip.To4() != nil {
+		req = append(append(req, 1), ip.To4()...)
+	} else if ip != nil {
+		req = append(append(req, 4), ip...)
+	} else {
+		req = append(append(req, 3, byte(len(host))), host...)
+	}
+	req = binary.BigEndian.AppendUint16(req, uint16(port))
+	_, err = c.Write(req)
+	if err != nil {
+		return err
+	}
+
+	var h [4]byte // version, reply, reserved, address type
+	_, err = io.ReadFull(c, h[:])
+	if err != nil {
+		return err
+	}
+	if h[1] != 0 {
+		return fmt.Errorf("socks5: connect failed with reply %d", h[1])
+	}
+	var skip int // bound address and port
+	switch h[3] {
+	case 1:
+		skip = 4 + 2
+	case 4:
+		skip = 16 + 2
+	case 3:
+		var n [1]byte
+		_, err = io.ReadFull(c, n[:])
+		if err != nil {
+			return err
+		}
+		skip = int(n[0]) + 2
+	default:
+		return errors.New("socks5: invalid reply")
+	}
+	_, err = io.ReadFull(c, make([]byte, skip))
+	return err
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"bufio"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// startProxy runs an http CONNECT or socks5 proxy, it returns its address
+// and a channel with the addresses it connected to
+func startProxy(t *testing.T, socks bool) (string, chan string) {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	targets := make(chan string, 10)
+
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				var addr string
+				if socks {
+					var h [3]byte
+					io.ReadFull(c, h[:])
+					c.Write([]byte{5, 0})
+					var req [5]byte // version, connect, reserved, type 3, length
+					io.ReadFull(c, req[:])
+					host := make([]byte, int(req[4])+2)
+					io.ReadFull(c, host)
+					addr = fmt.Sprintf("%s:%d", host[:req[4]], binary.BigEndian.Uint16(host[req[4]:]))
+				} else {
+					req, err := http.ReadRequest(bufio.NewReader(c))
+					if err != nil || req.Method != "CONNECT" {
+						return
+					}
+					addr = req.Host
+				}
+				targets <- addr
+
+				u, err := net.Dial("tcp", addr)
+				if err != nil {
+					return
+				}
+				defer u.Close()
+				if socks {
+					c.Write([]byte{5, 0, 0, 1, 0, 0, 0, 0, 0, 0})
+				} else {
+					io.WriteString(c, "HTTP/1.1 200 Connection established\r\n\r\n")
+				}
+				go io.Copy(u, c)
+				io.Copy(c, u)
+			}()
+		}
+	}()
+	return l.Addr().String(), targets
+}
+
+func TestConnectProxy(t *testing.T) {
+	for _, scheme := range []string{"http", "socks5"} {
+		startBackend(t)
+		// by name, the socks5 proxy resolves it
+		_, port, _ := net.SplitHostPort(config.Endpoint)
+		config.Endpoint = "localhost:" + port
+
+		addr, targets := startProxy(t, scheme == "socks5")
+		config.Proxy = scheme + "://" + addr
+		b, err := Connect()
+		if err != nil {
+			t.Fatalf("%s: %v", scheme, err)
+		}
+		_, err = b.List("wal")
+		b.Close()
+		if err != nil {
+			t.Fatalf("%s: %v", scheme, err)
+		}
+		if target := <-targets; target != config.Endpoint {
+			t.Errorf("%s: proxy connected to %s, want %s", scheme, target, config.Endpoint)
+		}
+	}
+}
+
+func TestConnectPins(t *testing.T) {
+	startBackend(t)
+	cert, err := serverCert(filepath.Dir(config.EndpointCA))
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf := cert.Leaf
+	if leaf == nil {
+		t.Fatal("no leaf certificate")
+	}
+	pin := spkiPin(leaf)
+
+	for _, c := range []struct {
+		ca, pin string
+		tls     string
+		ok      bool
+	}{
+		{ca: config.EndpointCA, ok: true},
+		{ca: config.EndpointCA, pin: pin, ok: true},
+		{pin: pin, ok: true}, // self signed, only the pin
+		{pin: pin, tls: "1.3", ok: true},
+		{ca: config.EndpointCA, pin: "AAAA", ok: false},
+		{pin: "AAAA", ok: false},
+		{ok: false}, // not in the system roots
+	} {
+		config.EndpointCA = c.ca
+		config.EndpointPins = nil
+		if c.pin != "" {
+			config.EndpointPins = []string{c.pin}
+		}
+		config.TLSMinVersion = c.tls
+		b, err := Connect()
+		if err == nil {
+			b.Close()
+		}
+		if (err == nil) != c.ok {
+			t.Errorf("ca %q pin %q: %v", c.ca, c.pin, err)
+		}
+		if err != nil && c.pin == "AAAA" && !strings.Contains(err.Error(), pin) {
+			t.Errorf("error doesn't tell the pin: %v", err)
+		}
+	}
+
+	// a server sending along the pinned certificate, with a leaf of its own
+	// or one the pinned one signed
+	config.EndpointCA = ""
+	config.EndpointPins = []string{pin}
+	config.TLSMinVersion = ""
+	for _, signed := range []bool{false, true} {
+		key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		tmpl := &x509.Certificate{
+			SerialNumber: big.NewInt(2),
+			NotBefore:    time.Now().Add(-time.Hour),
+			NotAfter:     time.Now().Add(time.Hour),
+			ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+			IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+		}
+		parent, signer := tmpl, interface{}(key)
+		if signed {
+			parent, signer = leaf, cert.PrivateKey
+		}
+		der, err := x509.CreateCertificate(rand.Reader, tmpl, parent, &key.PublicKey, signer)
+		if err != nil {
+			t.Fatal(err)
+		}
+		config.Endpoint = serveChain(t, tls.Certificate{Certificate: [][]byte{der, leaf.Raw}, PrivateKey: key})
+		b, err := Connect()
+		if err == nil {
+			b.Close()
+		}
+		if (err == nil) != signed {
+			t.Errorf("leaf signed by the pinned certificate %v: %v", signed, err)
+		}
+	}
+}
+
+// serveChain runs a tls server that sends cert, it returns its address
+func serveChain(t *testing.T, cert tls.Certificate) string {
+	t.Helper()
+	l, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{cert}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				io.Copy(ioutil.Discard, c)
+			}()
+		}
+	}()
+	return l.Addr().String()
+}
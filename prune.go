@@ -0,0 +1,234 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"sort"
+	"time"
+)
+
+// retention is the "retention" section of pgbackup.conf, eg
+// {"daily": 7, "weekly": 4, "monthly": 12} or {"windowDays": 14}. A base
+// backup is kept if any rule wants it.
+type retention struct {
+	Daily      int `json:"daily,omitempty"`      // the latest base of each of the last n days with one
+	Weekly     int `json:"weekly,omitempty"`     // same, per iso week
+	Monthly    int `json:"monthly,omitempty"`    // same, per month
+	WindowDays int `json:"windowDays,omitempty"` // can restore to any point in the last n days
+}
+
+// retainBases decides which bases (in chronological order) to keep. The
+// latest is always kept, and so are the parents of kept incrementals.
+func retainBases(bases []*baseMeta, r retention, now time.Time) (map[*baseMeta]bool, error) {
+	keep := map[*baseMeta]bool{}
+	if len(bases) == 0 {
+		return keep, nil
+	}
+	keep[bases[len(bases)-1]] = true
+
+	periods := []struct {
+		n   int
+		key func(t time.Time) string
+	}{
+		{r.Daily, func(t time.Time) string { return t.Format("2006-01-02") }},
+		{r.Weekly, func(t time.Time) string { y, w := t.ISOWeek(); return fmt.Sprint(y, w) }},
+		{r.Monthly, func(t time.Time) string { return t.Format("2006-01") }},
+	}
+	for _, p := range periods {
+		seen := map[string]bool{}
+		for i := len(bases) - 1; i >= 0; i-- {
+			t := bases[i].StartTime.Local()
+			if bases[i].StartTime.IsZero() || seen[p.key(t)] || len(seen) >= p.n {
+				continue
+			}
+			seen[p.key(t)] = true
+			keep[bases[i]] = true
+		}
+	}
+
+	if r.WindowDays > 0 {
+		start := now.AddDate(0, 0, -r.WindowDays)
+		for i := len(bases) - 1; i >= 0; i-- {
+			keep[bases[i]] = true
+			if bases[i].StartTime.Before(start) {
+				break // the one to restore the start of the window from
+			}
+		}
+	}
+
+	// we can't tell the age of old bases without a time, so leave them be
+	for _, m := range bases {
+		if m.StartTime.IsZero() {
+			keep[m] = true
+		}
+	}
+
+	for m := range keep {
+		chain, err := baseChain(bases, m)
+		if err != nil {
+			return nil, err
+		}
+		for _, c := range chain {
+			keep[c] = true
+		}
+	}
+	return keep, nil
+}
+
+// baseFiles lists all objects of a base backup
+func baseFiles(m *baseMeta) []string {
+	var files []string
+	parted := false // the data directory
+	for _, ts := range m.Tablespaces {
+		for _, p := range ts.Parts {
+			files = append(files, p.File)
+		}
+		if ts.Oid == "" {
+			parted = len(ts.Parts) > 0
+		} else if len(ts.Parts) == 0 {
+			files = append(files, archiveFile(m, ts.Oid))
+		}
+	}
+	if !parted {
+		files = append([]string{m.File}, files...)
+	}
+	if m.Manifest != "" {
+		files = append(files, m.Manifest)
+	}
+	if !m.legacy {
+		files = append(files, metaFile(m.File))
+	}
+	return files
+}
+
+// walCutoffs returns from where the wal of each timeline is needed by the
+// kept bases. A base is restored on its own timeline and on those that
+// branched off it after it was consistent, from where they branched off, by
+// their history files. Timelines no base leads to aren't in it. Those without
+// a history file, and bases of an unknown timeline, go by the oldest base.
+func walCutoffs(kept []*baseMeta, timelines []int, histories map[int][]historyEntry) map[int]LSN {
+	cutoffs := map[int]LSN{}
+	for _, t := range timelines {
+		h, known := histories[t]
+		known = known || t == 1
+		var branch LSN
+		if len(h) > 0 {
+			branch = h[len(h)-1].Lsn
+		}
+		for _, m := range kept {
+			leads := m.Timeline == 0 || m.Timeline == t || !known
+			for _, e := range h {
+				leads = leads || e.Timeline == m.Timeline && m.Consistent() <= e.Lsn
+			}
+			if !leads {
+				continue
+			}
+			from := m.StartLsn
+			if known && branch > from {
+				from = branch
+			}
+			if c, ok := cutoffs[t]; !ok || from < c {
+				cutoffs[t] = from
+			}
+		}
+	}
+	return cutoffs
+}
+
+// Prune deletes the base backups the retention policy doesn't keep, and the
+// wal (and indexes) the kept ones don't need: on each timeline from before
+// where they need it, and all of the timelines they don't lead to
+func Prune(dryRun bool) error {
+	r := config.Retention
+	if r.Daily == 0 && r.Weekly == 0 && r.Monthly == 0 && r.WindowDays == 0 {
+		return errors.New("no retention configured in pgbackup.conf")
+	}
+
+	backend, err := Connect()
+	if err != nil {
+		return err
+	}
+	defer backend.Close()
+
+	bases, err := listBases(backend, true)
+	if err != nil {
+		return err
+	}
+	keep, err := retainBases(bases, r, time.Now())
+	if err != nil {
+		return err
+	}
+	if len(keep) == 0 {
+		return errors.New("no base backups, not pruning wal")
+	}
+	histories, err := readHistories(backend)
+	if err != nil {
+		return err
+	}
+
+	var del []string
+	var kept []*baseMeta
+	for _, m := range bases {
+		if keep[m] {
+			out("keep base %s (%s)", m.File, m.StartTime.Local().Format("2006-01-02 15:04"))
+			kept = append(kept, m)
+			continue
+		}
+		del = append(del, baseFiles(m)...)
+	}
+
+	var files []string
+	var segs []walSegment
+	seen := map[int]bool{}
+	var timelines []int
+	for _, ext := range []string{"wal", "idx"} {
+		ls, err := backend.List(ext)
+		if err != nil {
+			return err
+		}
+		for _, f := range ls {
+			var s walSegment
+			if n, _ := fmt.Sscanf(f, "%016x.%d."+ext, &s.Segment, &s.Timeline); n != 2 {
+				continue
+			}
+			files, segs = append(files, f), append(segs, s)
+			if !seen[s.Timeline] {
+				seen[s.Timeline] = true
+				timelines = append(timelines, s.Timeline)
+			}
+		}
+	}
+	sort.Ints(timelines)
+	cutoffs := walCutoffs(kept, timelines, histories)
+	for _, t := range timelines {
+		if c, ok := cutoffs[t]; ok {
+			out("keep wal of timeline %d from %s", t, c)
+		} else {
+			out("no kept base leads to timeline %d, deleting its wal", t)
+		}
+	}
+	for i, s := range segs {
+		if c, ok := cutoffs[s.Timeline]; !ok || s.Lsn()+segmentSize <= c {
+			del = append(del, files[i])
+		}
+	}
+
+	for _, f := range del {
+		if dryRun {
+			out("would delete %s", f)
+			continue
+		}
+		slog.Info("delete", "file", f)
+		err := backend.Delete(f)
+		if err != nil {
+			return fmt.Errorf("%s: %s", f, err)
+		}
+	}
+	deleted := "deleted"
+	if dryRun {
+		deleted = "would be deleted (dry run)"
+	}
+	out("%d files %s, kept %d of %d base backups", len(del), deleted, len(keep), len(bases))
+	return nil
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRetainBases(t *testing.T) {
+	// 2024-01-15 is a monday, 2023-12-31 a sunday in week 52 of 2023
+	times := []string{
+		"2023-11-20 03:00",
+		"2023-12-10 03:00",
+		"2023-12-31 03:00",
+		"2024-01-08 03:00",
+		"2024-01-10 03:00",
+		"2024-01-10 15:00",
+		"2024-01-13 03:00",
+		"2024-01-14 03:00",
+		"2024-01-15 03:00",
+	}
+	now, _ := time.ParseInLocation("2006-01-02 15:04", "2024-01-15 12:00", time.Local)
+
+	for _, c := range []struct {
+		name    string
+		r       retention
+		parents map[int]int // incremental base: parent
+		zero    []int       // legacy bases without a start time
+		keep    string
+	}{
+		{"daily", retention{Daily: 3}, nil, nil, "6 7 8"},
+		{"latest of a day", retention{Daily: 5}, nil, nil, "3 5 6 7 8"},
+		{"weekly", retention{Weekly: 2}, nil, nil, "7 8"},
+		{"weekly across years", retention{Weekly: 3}, nil, nil, "2 7 8"},
+		{"monthly", retention{Monthly: 3}, nil, nil, "0 2 8"},
+		{"combined", retention{Daily: 1, Monthly: 2}, nil, nil, "2 8"},
+		{"window", retention{WindowDays: 3}, nil, nil, "5 6 7 8"},
+		{"window before all", retention{WindowDays: 100}, nil, nil, "0 1 2 3 4 5 6 7 8"},
+		{"window and monthly", retention{WindowDays: 1, Monthly: 2}, nil, nil, "2 7 8"},
+		{"latest", retention{Monthly: 1}, nil, nil, "8"},
+		{"parents", retention{Daily: 1}, map[int]int{8: 7, 7: 3}, nil, "3 7 8"},
+		{"no time", retention{Daily: 2}, nil, []int{1}, "1 7 8"},
+	} {
+		var bases []*baseMeta
+		for i, s := range times {
+			m := &baseMeta{File: fmt.Sprintf("%016x.base", i)}
+			m.StartTime, _ = time.ParseInLocation("2006-01-02 15:04", s, time.Local)
+			bases = append(bases, m)
+		}
+		for i, p := range c.parents {
+			bases[i].Parent = bases[p].File
+		}
+		for _, i := range c.zero {
+			bases[i].StartTime = time.Time{}
+		}
+
+		keep, err := retainBases(bases, c.r, now)
+		if err != nil {
+			t.Errorf("%s: %s", c.name, err)
+			continue
+		}
+		var got []string
+		for i, m := range bases {
+			if keep[m] {
+				got = append(got, fmt.Sprint(i))
+			}
+		}
+		sort.Strings(got)
+		if strings.Join(got, " ") != c.keep {
+			t.Errorf("%s: kept %s, want %s", c.name, got, c.keep)
+		}
+	}
+
+	// an incremental without its parent can't be restored
+	bases := []*baseMeta{{File: "0000000000000001.base", StartTime: now, Parent: "0000000000000000.base"}}
+	if _, err := retainBases(bases, retention{Daily: 1}, now); err == nil {
+		t.Error("kept an incremental without its parent")
+	}
+}
+
+func TestWalCutoffs(t *testing.T) {
+	// timeline 2 branched off 1 at 0/30..., 3 off 2 at 0/50..., and 4 off 1
+	// at 0/20... by a point in time recovery from a base before that
+	histories := map[int][]historyEntry{
+		2: {{1, 0x30000a0}},
+		3: {{1, 0x30000a0}, {2, 0x50000a0}},
+		4: {{1, 0x20000a0}},
+	}
+	base := func(timeline int, start LSN) *baseMeta {
+		return &baseMeta{StartLsn: start, EndLsn: start + 0x100, Timeline: timeline}
+	}
+
+	for _, c := range []struct {
+		name string
+		kept []*baseMeta
+		want string
+	}{
+		{"before all switches", []*baseMeta{base(1, 0x1000028)}, "1:0/01000028 2:0/030000a0 3:0/050000a0 4:0/020000a0"},
+		{"past the switch to 4", []*baseMeta{base(1, 0x2800028)}, "1:0/02800028 2:0/030000a0 3:0/050000a0"},
+		{"on a child", []*baseMeta{base(2, 0x4000028)}, "2:0/04000028 3:0/050000a0"},
+		{"latest timeline", []*baseMeta{base(3, 0x6000028)}, "3:0/06000028"},
+		{"dead fork", []*baseMeta{base(4, 0x6000028), base(3, 0x7000028)}, "3:0/07000028 4:0/06000028"},
+		{"unknown timeline", []*baseMeta{{StartLsn: 0x4000028}}, "1:0/04000028 2:0/04000028 3:0/050000a0 4:0/04000028 5:0/04000028"},
+		{"no history", []*baseMeta{base(3, 0x6000028)}, "3:0/06000028 5:0/06000028"},
+	} {
+		timelines := []int{1, 2, 3, 4}
+		if c.name == "unknown timeline" || c.name == "no history" { // 5 has no history file
+			timelines = append(timelines, 5)
+		}
+		cutoffs := walCutoffs(c.kept, timelines, histories)
+		var got []string
+		for _, tl := range timelines {
+			if lsn, ok := cutoffs[tl]; ok {
+				got = append(got, fmt.Sprintf("%d:%s", tl, lsn))
+			}
+		}
+		if strings.Join(got, " ") != c.want {
+			t.Errorf("%s: %s, want %s", c.name, strings.Join(got, " "), c.want)
+		}
+	}
+}
@@ -0,0 +1,232 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log/slog"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"./pg"
+)
+
+type restoreTestOptions struct {
+	Sql      string        // extra sanity query
+	User     string        // superuser of the cluster
+	Bin      string        // postgres binary, found from PG_VERSION if empty
+	Timeout  time.Duration // for recovery
+	Keep     bool          // leave the restored directory
+	Settings []string      // extra -c settings
+}
+
+// settingList collects --set flags
+type settingList []string
+
+func (l *settingList) String() string {
+	return fmt.Sprint(*l)
+}
+
+func (l *settingList) Set(s string) error {
+	*l = append(*l, s)
+	return nil
+}
+
+type restoreTestReport struct {
+	Ok              bool      `json:"ok"`
+	Error           string    `json:"error,omitempty"`
+	Start           time.Time `json:"start"`
+	Dir             string    `json:"dir,omitempty"`
+	Base            LSN       `json:"base,omitempty"` // start of the restored base
+	ServerVersion   string    `json:"serverVersion,omitempty"`
+	Lsn             string    `json:"lsn,omitempty"` // where recovery ended
+	RestoreSeconds  float64   `json:"restoreSeconds"`
+	RecoverySeconds float64   `json:"recoverySeconds"`
+	TotalSeconds    float64   `json:"totalSeconds"`
+	Relations       int64     `json:"relations,omitempty"` // count(*) from pg_class
+	SqlRows         int       `json:"sqlRows,omitempty"`
+}
+
+// RestoreTest restores the latest base and all wal after it into a temporary
+// directory, starts postgres on it and runs some queries. It prints a json
+// report, and fails if anything went wrong.
+func RestoreTest(opts restoreTestOptions) error {
+	r := &restoreTestReport{Start: time.Now()}
+	err := restoreTest(opts, r)
+	r.Ok = err == nil
+	if err != nil {
+		r.Error = err.Error()
+	}
+	r.TotalSeconds = time.Since(r.Start).Seconds()
+
+	d, _ := json.MarshalIndent(r, "", "  ")
+	os.Stdout.Write(append(d, '\n'))
+	if err != nil {
+		return errors.New("restore test failed")
+	}
+	return nil
+}
+
+func restoreTest(opts restoreTestOptions, r *restoreTestReport) error {
+	tmp, err := ioutil.TempDir("", "pgbackup-restore-test-")
+	if err != nil {
+		return err
+	}
+	if opts.Keep {
+		r.Dir = tmp
+	} else {
+		defer os.RemoveAll(tmp)
+	}
+	dir := filepath.Join(tmp, "data")
+
+	err = Restore(restoreOptions{Latest: true, Dir: dir, TablespaceDir: filepath.Join(tmp, "tablespaces")})
+	if err != nil {
+		return err
+	}
+	r.RestoreSeconds = time.Since(r.Start).Seconds()
+	if f, err := os.Open(filepath.Join(dir, "backup_label")); err == nil {
+		if l, err := parseBackupLabel(f); err == nil {
+			r.Base = l.Lsn
+		}
+		f.Close()
+	}
+
+	// a data directory doesn't always have its config (eg on debian), and we
+	// want our own access rules and only a unix socket in tmp
+	conf := filepath.Join(dir, "postgresql.conf")
+	if _, err := os.Stat(conf); os.IsNotExist(err) {
+		err = ioutil.WriteFile(conf, nil, 0600)
+		if err != nil {
+			return err
+		}
+	}
+	hba := filepath.Join(tmp, "pg_hba.conf")
+	err = ioutil.WriteFile(hba, []byte("local all all trust\n"), 0600)
+	if err != nil {
+		return err
+	}
+	port, err := freePort()
+	if err != nil {
+		return err
+	}
+
+	bin := opts.Bin
+	if bin == "" {
+		bin = fmt.Sprintf("/usr/lib/postgresql/%d/bin/postgres", pgVersion(dir))
+		if _, err := os.Stat(bin); err != nil {
+			bin = "postgres"
+		}
+	}
+	args := []string{"-D", dir,
+		"-c", "port=" + strconv.Itoa(port),
+		"-c", "listen_addresses=",
+		"-c", "unix_socket_directories=" + tmp,
+		"-c", "hba_file=" + hba,
+		"-c", "archive_mode=off",
+		"-c", "hot_standby=on",
+	}
+	for _, s := range opts.Settings {
+		args = append(args, "-c", s)
+	}
+	logFile, err := os.Create(filepath.Join(tmp, "postgres.log"))
+	if err != nil {
+		return err
+	}
+	defer logFile.Close()
+
+	slog.Info("starting postgres", "bin", bin, "dir", dir, "port", port)
+	cmd := exec.Command(bin, args...)
+	cmd.Stdout = logFile
+	cmd.Stderr = logFile
+	err = cmd.Start()
+	if err != nil {
+		return err
+	}
+	exited := make(chan error, 1)
+	go func() { exited <- cmd.Wait() }()
+	defer func() {
+		cmd.Process.Signal(os.Interrupt) // fast shutdown
+		select {
+		case <-exited:
+		case <-time.After(time.Minute):
+			cmd.Process.Kill()
+		}
+	}()
+
+	// wait for recovery to replay all wal and promote
+	connString := fmt.Sprintf("host=%s port=%d user=%s dbname=postgres", tmp, port, opts.User)
+	recoveryStart := time.Now()
+	var pc *pg.Conn
+	for {
+		select {
+		case err := <-exited:
+			exited <- err // for the deferred shutdown
+			return fmt.Errorf("postgres exited: %v, see %s", err, logFile.Name())
+		case <-time.After(time.Second):
+		}
+		if time.Since(recoveryStart) > opts.Timeout {
+			return fmt.Errorf("recovery didn't finish in %s", opts.Timeout)
+		}
+
+		if pc == nil {
+			pc, err = pg.NewConn(connString)
+			if err != nil {
+				slog.Debug("waiting for postgres", "err", err)
+				pc = nil
+				continue
+			}
+			defer pc.Close()
+			r.ServerVersion = pc.ServerVersion
+		}
+		rows, err := pc.SimpleQuery("SELECT pg_is_in_recovery(), pg_last_wal_replay_lsn()::text")
+		if err != nil {
+			return err
+		}
+		if len(rows) == 1 && len(rows[0]) == 2 {
+			r.Lsn, _ = rows[0][1].(string)
+			if inRecovery, _ := rows[0][0].(bool); !inRecovery {
+				break
+			}
+			slog.Debug("recovering", "lsn", r.Lsn)
+		}
+	}
+	r.RecoverySeconds = time.Since(recoveryStart).Seconds()
+	slog.Info("recovered", "lsn", r.Lsn, "seconds", int(r.RecoverySeconds))
+
+	rows, err := pc.SimpleQuery("SELECT count(*) FROM pg_class")
+	if err != nil {
+		return err
+	}
+	if len(rows) != 1 || len(rows[0]) != 1 {
+		return errors.New("unexpected result from pg_class")
+	}
+	r.Relations, _ = rows[0][0].(int64)
+	if r.Relations == 0 {
+		return errors.New("pg_class is empty")
+	}
+
+	if opts.Sql != "" {
+		rows, err := pc.SimpleQuery(opts.Sql)
+		if err != nil {
+			return fmt.Errorf("sql: %s", err)
+		}
+		r.SqlRows = len(rows)
+	}
+	return nil
+}
+
+// freePort finds a tcp port nobody listens on, postgres uses it for the name
+// of its socket
+func freePort() (int, error) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return 0, err
+	}
+	defer l.Close()
+	return l.Addr().(*net.TCPAddr).Port, nil
+}
@@ -0,0 +1,324 @@
+package main
+
+// a reference implementation of the backend line protocol, storing the files
+// of every account in its own directory
+
+import (
+	"bufio"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log/slog"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Serve runs a backend on addr, keeping files in dir. It creates a self
+// signed certificate dir/server.crt on first start, which clients need as
+// endpointCA.
+func Serve(dir, addr string) error {
+	err := os.MkdirAll(dir, 0700)
+	if err != nil {
+		return err
+	}
+	cert, err := serverCert(dir)
+	if err != nil {
+		return err
+	}
+	l, err := tls.Listen("tcp", addr, &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		ClientAuth:   tls.RequireAnyClientCert, // self signed, the key is the account
+		MinVersion:   tls.VersionTLS12,
+	})
+	if err != nil {
+		return err
+	}
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return err
+	}
+	slog.Info("serving", "addr", l.Addr(), "dir", dir, "cert", filepath.Join(dir, "server.crt"), "pin", spkiPin(leaf))
+	return serveBackend(l, dir)
+}
+
+// serveStat is a var for the tests, to answer for some account directories
+// like an older backend without pgbackup.stat
+var serveStat = func(dir string) bool { return true }
+
+func serveBackend(l net.Listener, dir string) error {
+	for {
+		c, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		go func() {
+			defer c.Close()
+			err := serveConn(c.(*tls.Conn), dir)
+			if err != nil && err != io.EOF {
+				slog.Warn("serve", "remote", c.RemoteAddr(), "err", err)
+			}
+		}()
+	}
+}
+
+// serverCert loads or creates the certificate of the backend
+func serverCert(dir string) (tls.Certificate, error) {
+	certFile, keyFile := filepath.Join(dir, "server.crt"), filepath.Join(dir, "server.key")
+	if cert, err := tls.LoadX509KeyPair(certFile, keyFile); err == nil {
+		return cert, nil
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	tmpl := x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().AddDate(10, 0, 0),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		DNSNames:              []string{"localhost"},
+		IPAddresses:           []net.IP{net.IPv4(127, 0, 0, 1), net.IPv6loopback},
+	}
+	if host, err := os.Hostname(); err == nil {
+		tmpl.DNSNames = append(tmpl.DNSNames, host)
+		tmpl.Subject.CommonName = host
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &tmpl, &tmpl, &key.PublicKey, key)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	der1, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	err = ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der1}), 0600)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	err = ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	slog.Info("created certificate", "file", certFile)
+	return tls.LoadX509KeyPair(certFile, keyFile)
+}
+
+// validFile guards the account directory, names are like 0000000000000001.1.wal
+func validFile(name string) bool {
+	if name == "" || name[0] == '.' || len(name) > 128 {
+		return false
+	}
+	for _, r := range name {
+		if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '.' || r == '-' || r == '_') {
+			return false
+		}
+	}
+	return true
+}
+
+func serveConn(c *tls.Conn, dir string) error {
+	err := c.Handshake()
+	if err != nil {
+		return err
+	}
+	certs := c.ConnectionState().PeerCertificates
+	if len(certs) == 0 {
+		return errors.New("no client certificate")
+	}
+	account, err := accountId(certs[0].PublicKey)
+	if err != nil {
+		return err
+	}
+	slog.Debug("serve connection", "remote", c.RemoteAddr(), "account", account)
+	return serveFiles(c, filepath.Join(dir, account), account)
+}
+
+// serveFiles answers the requests on c from the files in dir, for a storage
+// with dir it runs in the agent itself
+func serveFiles(c io.ReadWriter, dir, account string) error {
+	err := os.MkdirAll(dir, 0700)
+	if err != nil {
+		return err
+	}
+
+	rd := bufio.NewReader(c)
+	w := bufio.NewWriter(c)
+	for {
+		l, err := rd.ReadString('\n')
+		if err != nil {
+			return err
+		}
+		cmd := strings.Fields(l)
+		if len(cmd) == 0 {
+			continue
+		}
+		arg := ""
+		if len(cmd) > 1 {
+			arg = cmd[1]
+		}
+		slog.Debug("serve", "account", account, "cmd", cmd[0], "arg", arg)
+
+		switch {
+		case cmd[0] == "pgbackup.put" && validFile(arg):
+			err = servePut(rd, dir, arg)
+			if err != nil {
+				return err // the stream is out of sync
+			}
+			continue // no reply
+
+		case cmd[0] == "pgbackup.get" && validFile(arg):
+			f, err := os.Open(filepath.Join(dir, arg))
+			if os.IsNotExist(err) {
+				fmt.Fprintf(w, "notFound\n")
+				break
+			}
+			if err != nil {
+				return err
+			}
+			st, err := f.Stat()
+			if err == nil {
+				fmt.Fprintf(w, "%x\n", st.Size())
+				_, err = io.CopyN(w, f, st.Size())
+			}
+			f.Close()
+			if err != nil {
+				return err
+			}
+
+		case cmd[0] == "pgbackup.list" && validFile(arg):
+			names, err := listFiles(dir, "."+arg)
+			if err != nil {
+				return err
+			}
+			fmt.Fprintf(w, "%s\n", strings.Join(names, " "))
+
+		case cmd[0] == "pgbackup.stat" && serveStat(dir) && validFile(arg):
+			// size and sha256, to confirm an upload
+			f, err := os.Open(filepath.Join(dir, arg))
+			if os.IsNotExist(err) {
+				fmt.Fprintf(w, "notFound\n")
+				break
+			}
+			if err != nil {
+				return err
+			}
+			h := sha256.New()
+			n, err := io.Copy(h, f)
+			f.Close()
+			if err != nil {
+				return err
+			}
+			fmt.Fprintf(w, "%x %x\n", n, h.Sum(nil))
+
+		case cmd[0] == "pgbackup.delete" && validFile(arg):
+			err := os.Remove(filepath.Join(dir, arg))
+			if os.IsNotExist(err) {
+				fmt.Fprintf(w, "notFound\n")
+			} else if err != nil {
+				fmt.Fprintf(w, "failed\n")
+			} else {
+				fmt.Fprintf(w, "ok\n")
+			}
+
+		case cmd[0] == "pgbackup.status":
+			s := serveStatus(dir, account)
+			fmt.Fprintf(w, "%x\n%s", len(s), s)
+
+		default:
+			fmt.Fprintf(w, "unknownCommand\n")
+		}
+		err = w.Flush()
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// servePut reads chunks into a temporary file, which replaces file once the
+// final (empty) chunk arrives
+func servePut(rd *bufio.Reader, dir, file string) error {
+	f, err := ioutil.TempFile(dir, ".put-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	for {
+		l, err := rd.ReadString('\n')
+		if err != nil {
+			return err
+		}
+		n, err := strconv.ParseInt(strings.TrimSpace(l), 16, 64)
+		if err != nil || n < 0 {
+			return fmt.Errorf("put %s: invalid chunk size %q", file, l)
+		}
+		if n == 0 {
+			break
+		}
+		_, err = io.CopyN(f, rd, n)
+		if err != nil {
+			return err
+		}
+	}
+	err = f.Close()
+	if err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), filepath.Join(dir, file))
+}
+
+func listFiles(dir, suffix string) ([]string, error) {
+	fs, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, f := range fs {
+		if strings.HasSuffix(f.Name(), suffix) && validFile(f.Name()) {
+			names = append(names, f.Name())
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+func serveStatus(dir, account string) string {
+	s := fmt.Sprintf("account: %s\n", account)
+	if d, err := ioutil.ReadFile(filepath.Join(dir, "email")); err == nil {
+		s += fmt.Sprintf("email: %s\n", d)
+	}
+	for _, ext := range []string{"wal", "base", "part", "meta", "idx"} {
+		names, _ := listFiles(dir, "."+ext)
+		var size int64
+		for _, n := range names {
+			if st, err := os.Stat(filepath.Join(dir, n)); err == nil {
+				size += st.Size()
+			}
+		}
+		s += fmt.Sprintf("%s: %d files, %d bytes", ext, len(names), size)
+		if len(names) > 0 {
+			s += fmt.Sprintf(", %s - %s", names[0], names[len(names)-1])
+		}
+		s += "\n"
+	}
+	return s
+}
@@ -53,10 +53,20 @@ To get started, enter your database credentials:`)
 
 	var testConn *pg.Conn
 	for {
-		host := ask("host (eg 127.0.0.1 or /some/path)")
+		host := ask("host (eg 127.0.0.1 or /some/path), or 'archive' to use archive_command instead of replication")
 		if host == "" {
 			continue
 		}
+		if host == "archive" {
+			dir := ask("data directory (eg /var/lib/postgresql/16/main)")
+			var err error
+			config.SystemId, err = controlSystemId(dir)
+			if err == nil {
+				break
+			}
+			out("Could not read the systemId: %s\n", err)
+			continue
+		}
 		port := ask("port [5432]")
 		if port == "" {
 			port = "5432"
@@ -75,17 +85,25 @@ To get started, enter your database credentials:`)
 	}
 
 	var err error
-	config.SystemId, _, _, err = testConn.IdentifySystem()
-	if err != nil {
-		return err
+	if testConn != nil {
+		config.SystemId, _, _, err = testConn.IdentifySystem()
+		if err != nil {
+			return err
+		}
+		out("\nConnected to postgresql %s", testConn.ServerVersion)
 	}
-
-	out("\nConnected to postgresql %s", testConn.ServerVersion)
 	out("systemId: %d", config.SystemId)
 
 	out("\nTo help us notify you about your backup, please enter")
 	config.Email = ask("your email address")
 
+	out("\nTo store backups elsewhere than pgbackup.com, eg with 'pgbackup serve', enter")
+	config.Endpoint = ask("backend host:port [" + defaultEndpoint + "]")
+	if config.Endpoint != "" {
+		config.EndpointCA = ask("its CA certificate file (eg server.crt of pgbackup serve) [system roots]")
+	}
+	config.Proxy = ask("proxy, eg http://proxy:3128 or socks5://proxy:1080 [none]")
+
 	_, err = rand.Read(config.key[:])
 	if err != nil {
 		return err
@@ -111,18 +129,24 @@ To get started, enter your database credentials:`)
 
 	out("Saved config to %s", confFile)
 
-	out("\nThere are 3 final steps for your database backup to begin")
-
-	out("\n1) Start '%s stream' as a background task", ourBin)
-	out("   To start right now: %s stream &", ourBin)
-	out("   To set things up more permanently, you could use this systemd")
-	out("   unit file: https://pgbackup.com/pgbackup.unit")
-
-	out("\n2) Schedule '%s basebackup' to run 3x per day", ourBin)
-	out("   For instance with the following crontab line:")
-	out("   0 5,13,21 * * * %s basebackup", ourBin)
+	out("\nThere are 2 final steps for your database backup to begin")
+
+	if testConn == nil {
+		out("\n1) Set in postgresql.conf, and restart postgres:")
+		out("   archive_mode = on")
+		out("   archive_command = '%s archive %%p %%f'", ourBin)
+		out("   Take base backups with pg_basebackup -Ft, or the tools you have,")
+		out("   and upload them with '%s import base'", ourBin)
+	} else {
+		out("\n1) Start '%s daemon' as a background task", ourBin)
+		out("   It streams the wal and takes a base backup 3x per day, change this")
+		out("   with baseCron (eg \"0 5,13,21 * * *\") or baseWalGB in %s", confFile)
+		out("   To start right now: %s daemon &", ourBin)
+		out("   To set things up more permanently, you could use this systemd")
+		out("   unit file: https://pgbackup.com/pgbackup.unit")
+	}
 
-	out("\n3) Save a copy of %s", confFile)
+	out("\n2) Save a copy of %s", confFile)
 	out("  Be sure to save it to a secure location, possibly encrypted,")
 	out("  as it contains the key to decrypt and restore your database.")
 
@@ -0,0 +1,335 @@
+package main
+
+import (
+	"archive/tar"
+	"bufio"
+	"crypto/cipher"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"./pg"
+)
+
+const segmentSize = 0x1000000
+
+// walSegment is a wal object in storage, named %016x.%d.wal after its
+// segment number (lsn >> 24) and timeline
+type walSegment struct {
+	Segment  uint64
+	Timeline int
+}
+
+func (s walSegment) File() string {
+	return fmt.Sprintf("%016x.%d.wal", s.Segment, s.Timeline)
+}
+
+func (s walSegment) Lsn() LSN {
+	return LSN(s.Segment << 24)
+}
+
+// parseWalList parses the reply to "pgbackup.list wal"
+func parseWalList(files []string) []walSegment {
+	var segs []walSegment
+	for _, f := range files {
+		var s walSegment
+		if n, _ := fmt.Sscanf(f, "%016x.%d.wal", &s.Segment, &s.Timeline); n == 2 {
+			segs = append(segs, s)
+		}
+	}
+	sort.Slice(segs, func(i, j int) bool {
+		if segs[i].Timeline != segs[j].Timeline {
+			return segs[i].Timeline < segs[j].Timeline
+		}
+		return segs[i].Segment < segs[j].Segment
+	})
+	return segs
+}
+
+// walRange is a contiguous run of wal on a timeline, End is exclusive
+type walRange struct {
+	Timeline int `json:"timeline"`
+	Start    LSN `json:"start"`
+	End      LSN `json:"end"`
+}
+
+func (r walRange) Contains(lsn LSN) bool {
+	return lsn >= r.Start && lsn < r.End
+}
+
+// walRanges folds segments into contiguous ranges per timeline, and returns
+// the holes between ranges of the same timeline as gaps
+func walRanges(segs []walSegment) (ranges, gaps []walRange) {
+	for _, s := range segs {
+		if n := len(ranges); n > 0 && ranges[n-1].Timeline == s.Timeline {
+			r := &ranges[n-1]
+			if r.End == s.Lsn() {
+				r.End += segmentSize
+				continue
+			}
+			gaps = append(gaps, walRange{Timeline: s.Timeline, Start: r.End, End: s.Lsn()})
+		}
+		ranges = append(ranges, walRange{Timeline: s.Timeline, Start: s.Lsn(), End: s.Lsn() + segmentSize})
+	}
+	return
+}
+
+// restorableEnd returns up to where wal can be replayed from lsn on timeline,
+// following switches to later timelines, or 0 if lsn is not covered
+func restorableEnd(ranges []walRange, timeline int, lsn LSN) LSN {
+	var cur *walRange
+	for i := range ranges {
+		if (timeline == 0 || ranges[i].Timeline == timeline) && ranges[i].Contains(lsn) {
+			cur = &ranges[i]
+			break
+		}
+	}
+	if cur == nil {
+		return 0
+	}
+	for {
+		// a new timeline starts within the segment of the switch
+		var next *walRange
+		for i := range ranges {
+			r := &ranges[i]
+			if r.Timeline > cur.Timeline && r.Start >= lsn&^(segmentSize-1) && r.Start < cur.End && r.End > cur.End {
+				if next == nil || r.Timeline > next.Timeline {
+					next = r
+				}
+			}
+		}
+		if next == nil {
+			return cur.End
+		}
+		lsn, cur = next.Start, next
+	}
+}
+
+// baseLabel is what we know about a base backup from its backup_label
+type baseLabel struct {
+	Lsn      LSN
+	Timeline int
+	Time     time.Time
+	Label    string
+}
+
+// readBackupLabel reads the backup_label from the first entries of the
+// (decrypted) base tar stream r
+func readBackupLabel(r io.Reader) (*baseLabel, error) {
+	tr := tar.NewReader(r)
+	for i := 0; i < 8; i++ {
+		h, err := tr.Next()
+		if err != nil {
+			return nil, err
+		}
+		if strings.TrimPrefix(h.Name, "./") == "backup_label" {
+			return parseBackupLabel(tr)
+		}
+	}
+	return nil, errors.New("no backup_label")
+}
+
+func parseBackupLabel(r io.Reader) (*baseLabel, error) {
+	var l baseLabel
+	s := bufio.NewScanner(r)
+	for s.Scan() {
+		kv := strings.SplitN(s.Text(), ": ", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		switch kv[0] {
+		case "START WAL LOCATION":
+			l.Lsn, _ = ParseLSN(strings.Fields(kv[1])[0])
+		case "START TIMELINE":
+			fmt.Sscanf(kv[1], "%d", &l.Timeline)
+		case "START TIME":
+			l.Time, _ = time.Parse("2006-01-02 15:04:05 MST", kv[1])
+		case "LABEL":
+			l.Label = kv[1]
+		}
+	}
+	if l.Lsn == 0 {
+		return nil, errors.New("invalid backup_label")
+	}
+	return &l, s.Err()
+}
+
+// baseBackupLabel fetches just enough of base backup file to read its
+// backup_label, using a connection of its own as we don't read the object
+// till the end
+func baseBackupLabel(file string) (*baseLabel, error) {
+	backend, err := Connect()
+	if err != nil {
+		return nil, err
+	}
+	defer backend.Close()
+
+	rd, _, err := backend.Get(file)
+	if err != nil {
+		return nil, err
+	}
+	return readBackupLabel(&cipher.StreamReader{R: rd, S: aesStream(file)})
+}
+
+type statusBase struct {
+	File       string     `json:"file"`
+	Lsn        LSN        `json:"lsn"`
+	EndLsn     LSN        `json:"endLsn,omitempty"`
+	Timeline   int        `json:"timeline,omitempty"`
+	Size       int64      `json:"size,omitempty"`
+	Time       *time.Time `json:"time,omitempty"`
+	AgeSeconds int64      `json:"ageSeconds,omitempty"`
+	Restorable LSN        `json:"restorableUntil,omitempty"` // 0 if its wal is missing
+	Wal        bool       `json:"wal,omitempty"`             // self-contained
+}
+
+type statusServer struct {
+	Lsn         LSN    `json:"lsn"`
+	Timeline    int    `json:"timeline"`
+	LagBytes    uint64 `json:"lagBytes"`    // upper bound, from the start of the latest archived segment
+	LagSegments uint64 `json:"lagSegments"` // 0 while streaming the server's current segment
+	Error       string `json:"error,omitempty"`
+}
+
+type statusReport struct {
+	SystemId uint64       `json:"systemId"`
+	Wal      []walRange   `json:"wal"`
+	Gaps     []walRange   `json:"gaps"`
+	Bases    []statusBase `json:"bases"`
+	Earliest LSN          `json:"earliest,omitempty"` // earliest restorable point
+	Latest   LSN          `json:"latest,omitempty"`   // latest restorable point
+
+	// commit times around the restorable points, from the segment indexes
+	EarliestTime *time.Time    `json:"earliestTime,omitempty"`
+	LatestTime   *time.Time    `json:"latestTime,omitempty"`
+	Server       *statusServer `json:"server,omitempty"`
+}
+
+// StatusJSON assembles the backup status from the wal and base listings and
+// writes it to stdout as json
+func StatusJSON() error {
+	backend, err := Connect()
+	if err != nil {
+		return err
+	}
+	defer backend.Close()
+
+	files, err := backend.List("wal")
+	if err != nil {
+		return err
+	}
+	segs := parseWalList(files)
+
+	// from the meta objects, bases from before those are described from
+	// their names without downloading them
+	bases, err := listBases(backend, false)
+	if err != nil {
+		return err
+	}
+
+	st := statusReport{SystemId: config.SystemId, Wal: []walRange{}, Gaps: []walRange{}, Bases: []statusBase{}}
+	st.Wal, st.Gaps = walRanges(segs)
+	if st.Gaps == nil {
+		st.Gaps = []walRange{}
+	}
+
+	for _, m := range bases {
+		b := statusBase{File: m.File, Lsn: m.StartLsn, EndLsn: m.EndLsn, Timeline: m.Timeline, Size: m.Size, Wal: m.Wal}
+		if !m.StartTime.IsZero() {
+			t := m.StartTime
+			b.Time = &t
+			b.AgeSeconds = int64(time.Since(t).Seconds())
+		}
+		b.Restorable = restorableEnd(st.Wal, b.Timeline, b.Lsn)
+		if b.Restorable < m.Consistent() {
+			b.Restorable = 0
+		}
+		if m.Wal && b.Restorable == 0 {
+			b.Restorable = m.Consistent() // needs no archived wal
+		}
+		if b.Restorable != 0 {
+			if st.Earliest == 0 || m.Consistent() < st.Earliest {
+				st.Earliest = m.Consistent()
+			}
+			if b.Restorable > st.Latest {
+				st.Latest = b.Restorable
+			}
+		}
+		st.Bases = append(st.Bases, b)
+	}
+
+	ixs, err := fetchIndexes(backend)
+	if err != nil {
+		return err
+	}
+	st.EarliestTime, st.LatestTime = restorableTimes(ixs, st.Earliest, st.Latest)
+
+	if config.PgConn != "" { // set up for archive_command only
+		st.Server = serverStatus(segs)
+	}
+
+	e := json.NewEncoder(os.Stdout)
+	e.SetIndent("", "  ")
+	return e.Encode(&st)
+}
+
+// restorableTimes returns the first commit time at or after earliest and
+// the last commit time before latest
+func restorableTimes(ixs map[walSegment]*segmentIndex, earliest, latest LSN) (first, last *time.Time) {
+	if latest == 0 {
+		return
+	}
+	var segs []walSegment
+	for s := range ixs {
+		segs = append(segs, s)
+	}
+	for _, s := range segmentTimelines(segs) {
+		ix := ixs[s]
+		if ix.FirstTime == nil || s.Lsn()+segmentSize <= earliest || s.Lsn() >= latest {
+			continue
+		}
+		if first == nil && ix.LastLsn >= earliest {
+			first = ix.FirstTime
+		}
+		last = ix.LastTime
+	}
+	return
+}
+
+// serverStatus compares the database's current position with the archive,
+// if the database is reachable
+func serverStatus(segs []walSegment) *statusServer {
+	pc, err := pg.NewConn(config.PgConn + " replication=true")
+	if err != nil {
+		return &statusServer{Error: err.Error()}
+	}
+	defer pc.Close()
+
+	systemId, timeline, lsn0, err := pc.IdentifySystem()
+	if err == nil && systemId != config.SystemId {
+		err = errors.New("systemId mismatch")
+	}
+	if err != nil {
+		return &statusServer{Error: err.Error()}
+	}
+
+	s := &statusServer{Timeline: timeline}
+	s.Lsn, _ = ParseLSN(lsn0)
+
+	var latest LSN
+	for _, seg := range segs {
+		if seg.Timeline == timeline && seg.Lsn() > latest {
+			latest = seg.Lsn()
+		}
+	}
+	if s.Lsn > latest {
+		s.LagBytes = uint64(s.Lsn - latest)
+		s.LagSegments = uint64(s.Lsn>>24) - uint64(latest>>24)
+	}
+	return s
+}
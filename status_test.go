@@ -0,0 +1,37 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func TestStatusJSON(t *testing.T) {
+	b := startBackend(t)
+	config.PgConn = ""
+	for i := 5; i <= 8; i++ {
+		b.put(walSegment{uint64(i), 1}.File(), nil)
+	}
+	// a legacy base isn't downloaded, this isn't even a tar
+	b.put("0000000000000005.base", []byte("not a tar"))
+	start := time.Now().Add(-time.Hour)
+	d, _ := json.Marshal(&baseMeta{File: "0000000000000006.base", StartLsn: 0x6000028, EndLsn: 0x6000100, Timeline: 1, StartTime: start})
+	b.putEncrypted("0000000000000006.meta", d)
+	b.put("0000000000000006.base", nil)
+
+	out, err := stdout(StatusJSON)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var st statusReport
+	if err := json.Unmarshal(out, &st); err != nil {
+		t.Fatalf("%s: %s", err, out)
+	}
+	if len(st.Bases) != 2 || st.Bases[0].Lsn != 0x5000000 || st.Bases[0].Time != nil || st.Bases[1].Time == nil || st.Bases[1].AgeSeconds < 3600 {
+		t.Errorf("bases %+v", st.Bases)
+	}
+	if st.Earliest != 0x5000000 || st.Latest != 0x9000000 || len(st.Wal) != 1 {
+		t.Errorf("status %s", out)
+	}
+}
@@ -0,0 +1,461 @@
+package main
+
+// base backup archives are uploaded in parts, so a broken connection only
+// costs the part it broke in, and an interrupted backup can be resumed
+
+import (
+	"bytes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"log/slog"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+var partSize = 64 << 20 // a var for the tests
+
+// basePart is a part of an archive in storage
+type basePart struct {
+	File      string `json:"file"`
+	Size      int64  `json:"size"`
+	Sha256    string `json:"sha256"`              // of the plain contents
+	EncSha256 string `json:"encSha256,omitempty"` // of the encrypted contents
+}
+
+// partFile names part i of archive. Parts are encrypted with an iv from
+// their name, so every attempt at a backup names its parts with a nonce of
+// its own, and no name is used for other contents.
+func partFile(archive, nonce string, i int) string {
+	return fmt.Sprintf("%s.%s.%04d.part", archive, nonce, i)
+}
+
+// uploadState is what an interrupted base backup uploaded, kept in
+// ~/.pgbackup-<systemId>.<label>.upload
+type uploadState struct {
+	File  string              `json:"file"`  // of the base
+	Nonce string              `json:"nonce"` // in the names of the parts of this attempt
+	Parts map[string]basePart `json:"parts"` // confirmed by the backend, of every attempt
+
+	used map[string]bool // parts of earlier attempts this one uses
+}
+
+func uploadStateFile(label string) string {
+	return fmt.Sprintf("%s/.pgbackup-%d.%s.upload", os.Getenv("HOME"), config.SystemId, hex.EncodeToString([]byte(label)))
+}
+
+func loadUploadState(label string) (*uploadState, error) {
+	d, err := ioutil.ReadFile(uploadStateFile(label))
+	if err != nil {
+		return nil, err
+	}
+	var s uploadState
+	err = json.Unmarshal(d, &s)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", uploadStateFile(label), err)
+	}
+	return &s, nil
+}
+
+func (s *uploadState) save(label string) error {
+	d, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+	file := uploadStateFile(label)
+	err = ioutil.WriteFile(file+".tmp", d, 0600)
+	if err != nil {
+		return err
+	}
+	return os.Rename(file+".tmp", file)
+}
+
+// partWriter uploads a tar archive in parts of up to partSize. Parts end
+// where a file starts, picked by its name once the part has a quarter of
+// partSize, so after a file that changed the parts line up again with those
+// of an earlier attempt. Files of half partSize and more get parts of their
+// own. Each part is confirmed by the backend before the next, and sent again
+// on a new connection if that fails. A part with the same contents as one in
+// the state isn't sent at all, the archive uses that one.
+type partWriter struct {
+	backend *Backend
+	archive string
+	state   *uploadState
+	label   string
+	buf     []byte // of the current part
+	parts   []basePart
+
+	header []byte // of the next file, while incomplete
+	left   int64  // bytes of the current file still to come, with padding
+	big    bool   // the current file has parts of its own
+}
+
+func (w *partWriter) Write(p []byte) (int, error) {
+	n := len(p)
+	for len(p) > 0 {
+		if w.left == 0 {
+			c := 512 - len(w.header)
+			if c > len(p) {
+				c = len(p)
+			}
+			w.header = append(w.header, p[:c]...)
+			p = p[c:]
+			if len(w.header) == 512 {
+				err := w.nextFile()
+				if err != nil {
+					return n - len(p), err
+				}
+			}
+			continue
+		}
+
+		c := partSize - len(w.buf)
+		if c > len(p) {
+			c = len(p)
+		}
+		if int64(c) > w.left {
+			c = int(w.left)
+		}
+		w.buf = append(w.buf, p[:c]...)
+		p = p[c:]
+		w.left -= int64(c)
+		if len(w.buf) == partSize {
+			err := w.flush()
+			if err != nil {
+				return n - len(p), err
+			}
+		}
+	}
+	return n, nil
+}
+
+// nextFile starts the file of the tar header in w.header, in a new part if
+// it's time for one
+func (w *partWriter) nextFile() error {
+	size, name := tarHeader(w.header)
+	big := size >= int64(partSize/2)
+	if len(w.buf) > 0 && (big || w.big || len(w.buf) >= partSize/2 || len(w.buf) >= partSize/4 && crc32.ChecksumIEEE([]byte(name))%8 == 0) {
+		err := w.flush()
+		if err != nil {
+			return err
+		}
+	}
+	w.buf = append(w.buf, w.header...)
+	w.header = w.header[:0]
+	w.left = (size + 511) &^ 511
+	w.big = big
+	return nil
+}
+
+// tarHeader returns the size and name of the file of a tar header block, or
+// of the end of the archive
+func tarHeader(h []byte) (int64, string) {
+	name := string(bytes.TrimRight(h[:100], "\x00"))
+	if string(h[257:262]) == "ustar" {
+		name = string(bytes.TrimRight(h[345:500], "\x00")) + "/" + name
+	}
+	var size int64
+	if h[124]&0x80 != 0 { // base-256, for 8GB and more
+		for _, c := range h[125:136] {
+			size = size<<8 | int64(c)
+		}
+	} else {
+		size, _ = strconv.ParseInt(strings.Trim(string(h[124:136]), " \x00"), 8, 64)
+	}
+	if size < 0 {
+		size = 0
+	}
+	return size, name
+}
+
+// Close uploads the last part, and confirms the parts a backend without
+// pgbackup.stat has all at once. Those it doesn't have are dropped from the
+// state, to be sent again when resuming.
+func (w *partWriter) Close() error {
+	w.buf = append(w.buf, w.header...) // not a tar after all
+	w.header = w.header[:0]
+	if len(w.buf) > 0 || len(w.parts) == 0 {
+		err := w.flush()
+		if err != nil {
+			return err
+		}
+	}
+	missing, err := w.backend.confirmPending()
+	if err != nil || len(missing) == 0 {
+		return err
+	}
+	for _, f := range missing {
+		delete(w.state.Parts, f)
+	}
+	err = w.state.save(w.label)
+	if err != nil {
+		return err
+	}
+	return fmt.Errorf("%s not stored", strings.Join(missing, ", "))
+}
+
+func (w *partWriter) flush() error {
+	sum := sha256.Sum256(w.buf)
+	part := basePart{File: partFile(w.archive, w.state.Nonce, len(w.parts)), Size: int64(len(w.buf)), Sha256: hex.EncodeToString(sum[:])}
+
+	if prev, ok := w.state.uploaded(part); ok {
+		slog.Debug("part uploaded before", "file", prev.File, "as", part.File)
+		part = prev
+	} else {
+		err := w.backend.retry(func() (err error) {
+			part.EncSha256, err = w.upload(part.File)
+			return err
+		})
+		if err != nil {
+			return err
+		}
+		slog.Debug("part uploaded", "file", part.File, "bytes", part.Size)
+		w.state.Parts[part.File] = part
+		err = w.state.save(w.label)
+		if err != nil {
+			return err
+		}
+	}
+	w.parts = append(w.parts, part)
+	w.buf = w.buf[:0]
+	return nil
+}
+
+// uploaded returns a part of an earlier attempt with the contents of part,
+// that isn't in use by this one yet
+func (s *uploadState) uploaded(part basePart) (basePart, bool) {
+	if s.used == nil {
+		s.used = map[string]bool{}
+	}
+	var names []string
+	for f := range s.Parts {
+		names = append(names, f)
+	}
+	sort.Strings(names)
+	for _, f := range names {
+		prev := s.Parts[f]
+		if prev.Size == part.Size && prev.Sha256 == part.Sha256 && !s.used[f] && !strings.Contains(f, "."+s.Nonce+".") {
+			s.used[f] = true
+			return prev, true
+		}
+	}
+	return basePart{}, false
+}
+
+// upload puts the current part as file and checks what the backend stored,
+// it returns the sha256 of the encrypted part
+func (w *partWriter) upload(file string) (string, error) {
+	err := w.backend.Send("pgbackup.put " + file)
+	if err != nil {
+		return "", err
+	}
+	h := sha256.New()
+	cw := &chunkWriter{W: w.backend.C}
+	sw := &cipher.StreamWriter{W: io.MultiWriter(cw, h), S: aesStream(file)}
+	for d := w.buf; len(d) > 0; {
+		c := len(d)
+		if c > 1<<20 {
+			c = 1 << 20
+		}
+		_, err = sw.Write(d[:c])
+		if err != nil {
+			return "", backendErr(err)
+		}
+		d = d[c:]
+	}
+	err = backendErr(cw.Close())
+	if err != nil {
+		return "", err
+	}
+	sum := hex.EncodeToString(h.Sum(nil))
+	return sum, w.backend.confirm(file, int64(len(w.buf)), sum)
+}
+
+// confirm checks the backend stored file with size and sha256 (of the
+// encrypted contents). Backends without pgbackup.stat only confirm it's there,
+// later with confirmPending.
+func (b *Backend) confirm(file string, size int64, sum string) error {
+	if !b.noStat {
+		rep, err := b.Request("pgbackup.stat " + file)
+		if err != nil {
+			return err
+		}
+		if rep != "unknownCommand" {
+			if rep != fmt.Sprintf("%x %s", size, sum) {
+				return fmt.Errorf("%s stored as %q", file, rep) // resent by retry
+			}
+			return nil
+		}
+		b.noStat = true
+	}
+	b.pending = append(b.pending, file)
+	return nil
+}
+
+// confirmPending checks the files confirm couldn't stat are there, with one
+// list for each extension, and returns those that aren't
+func (b *Backend) confirmPending() ([]string, error) {
+	listed := map[string]map[string]bool{}
+	var missing []string
+	for _, file := range b.pending {
+		ext := file[strings.LastIndex(file, ".")+1:]
+		if listed[ext] == nil {
+			files, err := b.List(ext)
+			if err != nil {
+				return nil, err
+			}
+			listed[ext] = map[string]bool{}
+			for _, f := range files {
+				listed[ext][f] = true
+			}
+		}
+		if !listed[ext][file] {
+			missing = append(missing, file)
+		}
+	}
+	b.pending = nil
+	return missing, nil
+}
+
+// openArchive returns a reader for the plain contents of archive file of
+// base, from its parts if it has them. It fails at the end of a part that
+// doesn't match its checksum.
+func openArchive(backend *Backend, base *baseMeta, file string) (io.Reader, error) {
+	for _, ts := range base.Tablespaces {
+		if archiveFile(base, ts.Oid) == file && len(ts.Parts) > 0 {
+			return &partReader{backend: backend, parts: ts.Parts}, nil
+		}
+	}
+	rd, _, err := backend.Get(file)
+	if err != nil {
+		return nil, err
+	}
+	return &cipher.StreamReader{R: rd, S: aesStream(file)}, nil
+}
+
+type partReader struct {
+	backend *Backend
+	parts   []basePart // still to read
+	rd      io.Reader  // of parts[0]
+	h, enc  hash.Hash  // of the plain and encrypted contents
+}
+
+func (r *partReader) Read(p []byte) (int, error) {
+	for {
+		if len(r.parts) == 0 {
+			return 0, io.EOF
+		}
+		part := r.parts[0]
+		if r.rd == nil {
+			rd, n, err := r.backend.Get(part.File)
+			if err != nil {
+				return 0, fmt.Errorf("%s: %s", part.File, err)
+			}
+			if n != part.Size {
+				io.Copy(ioutil.Discard, rd)
+				return 0, fmt.Errorf("%s: %d bytes, expected %d", part.File, n, part.Size)
+			}
+			r.h, r.enc = sha256.New(), sha256.New()
+			r.rd = io.TeeReader(&cipher.StreamReader{R: io.TeeReader(rd, r.enc), S: aesStream(part.File)}, r.h)
+		}
+		n, err := r.rd.Read(p)
+		if err == io.EOF {
+			if part.EncSha256 != "" && hex.EncodeToString(r.enc.Sum(nil)) != part.EncSha256 {
+				return n, fmt.Errorf("%s: checksum mismatch of the encrypted contents", part.File)
+			}
+			if hex.EncodeToString(r.h.Sum(nil)) != part.Sha256 {
+				return n, fmt.Errorf("%s: checksum mismatch", part.File)
+			}
+			r.parts, r.rd = r.parts[1:], nil
+			err = nil
+		}
+		if n > 0 || err != nil {
+			return n, err
+		}
+	}
+}
+
+// resumeUpload returns the upload state for a new base backup file, with
+// opts.Resume carrying over the parts of an interrupted one with the same
+// label for it to use. Without it, those parts are deleted.
+func resumeUpload(backend *Backend, opts baseOptions, file string) (*uploadState, error) {
+	s, err := loadUploadState(opts.Label)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if s != nil && s.File != "" {
+		metas, err := backend.List("meta")
+		if err != nil {
+			return nil, err
+		}
+		finished := false
+		for _, f := range metas {
+			finished = finished || f == metaFile(s.File)
+		}
+
+		switch {
+		case finished:
+			// stopped right after, its parts are in use
+		case opts.Resume:
+			slog.Info("resuming base backup", "file", file, "interrupted", s.File, "parts", len(s.Parts))
+			if s.Parts == nil {
+				s.Parts = map[string]basePart{}
+			}
+			s.File = file
+			s.Nonce, err = uploadNonce()
+			if err != nil {
+				return nil, err
+			}
+			return s, s.save(opts.Label)
+		default:
+			slog.Info("deleting interrupted base backup", "file", s.File, "parts", len(s.Parts))
+			for f := range s.Parts {
+				err := backend.Delete(f)
+				if err != nil {
+					slog.Warn("delete", "file", f, "err", err)
+				}
+			}
+		}
+	}
+
+	nonce, err := uploadNonce()
+	if err != nil {
+		return nil, err
+	}
+	s = &uploadState{File: file, Nonce: nonce, Parts: map[string]basePart{}}
+	return s, s.save(opts.Label)
+}
+
+func uploadNonce() (string, error) {
+	var b [4]byte
+	_, err := rand.Read(b[:])
+	return hex.EncodeToString(b[:]), err
+}
+
+// unused returns the parts of the state base m doesn't have, those of the
+// interrupted backup that came out different this time
+func (s *uploadState) unused(m *baseMeta) []string {
+	used := map[string]bool{}
+	for _, ts := range m.Tablespaces {
+		for _, p := range ts.Parts {
+			used[p.File] = true
+		}
+	}
+	var files []string
+	for f := range s.Parts {
+		if !used[f] {
+			files = append(files, f)
+		}
+	}
+	sort.Strings(files)
+	return files
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// listConn counts the list requests sent over it, and turns stat requests
+// into a command the backend doesn't know, like an older one
+type listConn struct {
+	net.Conn
+	lists int
+}
+
+func (c *listConn) Write(p []byte) (int, error) {
+	if strings.HasPrefix(string(p), "pgbackup.list ") {
+		c.lists++
+	}
+	if strings.HasPrefix(string(p), "pgbackup.stat ") {
+		p = append([]byte("pgbackup.xxxx "), p[len("pgbackup.stat "):]...)
+	}
+	return c.Conn.Write(p)
+}
+
+func TestPartWriterWithoutStat(t *testing.T) {
+	b := startBackend(t)
+	partSize = 1024
+	defer func() { partSize = 64 << 20 }()
+
+	backend, err := Connect()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer backend.Close()
+	c := &listConn{Conn: backend.C}
+	backend.C = c
+
+	// the parts are confirmed with one list for the archive
+	state := &uploadState{File: "0000000000000005.base", Nonce: "a", Parts: map[string]basePart{}}
+	w := &partWriter{backend: backend, archive: state.File, state: state, label: "nightly"}
+	w.Write(testTar(t, map[string]string{"PG_VERSION": "16\n", "base/5/1259": strings.Repeat("x", 4000)}))
+	err = w.Close()
+	if err != nil || len(w.parts) < 3 || c.lists != 1 {
+		t.Fatalf("%d parts, %d lists: %v", len(w.parts), c.lists, err)
+	}
+
+	// a part that isn't there fails the archive, and is sent again on resume
+	state.Nonce = "b"
+	w = &partWriter{backend: backend, archive: state.File, state: state, label: "nightly"}
+	w.Write(testTar(t, map[string]string{"base/5/1249": strings.Repeat("y", 4000)}))
+	lost := partFile(state.File, "b", 0)
+	b.wait(t, lost)
+	os.Remove(filepath.Join(b.dir, lost))
+	err = w.Close()
+	if err == nil || err.Error() != lost+" not stored" {
+		t.Fatalf("close: %v", err)
+	}
+	if _, ok := state.Parts[lost]; ok {
+		t.Error("lost part kept in the state")
+	}
+	if _, ok := state.Parts[partFile(state.File, "b", 1)]; !ok {
+		t.Error("stored part dropped from the state")
+	}
+}
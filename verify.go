@@ -0,0 +1,441 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"log/slog"
+	"strconv"
+	"strings"
+
+	"./wal"
+)
+
+// VerifyWal checks the wal archive for gaps and timeline inconsistencies,
+// and with download also checks the page headers and record crcs of every
+// segment. It prints a report and fails if anything is broken.
+func VerifyWal(download bool) error {
+	backend, err := Connect()
+	if err != nil {
+		return err
+	}
+	defer backend.Close()
+
+	files, err := backend.List("wal")
+	if err != nil {
+		return err
+	}
+	ranges, gaps := walRanges(parseWalList(files))
+
+	var problems int
+	problem := func(s string, args ...interface{}) {
+		problems++
+		out("BAD "+s, args...)
+	}
+
+	for _, r := range ranges {
+		out("wal timeline %d: %s - %s (%d segments)", r.Timeline, r.Start, r.End, (r.End-r.Start)/segmentSize)
+	}
+	for _, g := range gaps {
+		problem("timeline %d: missing wal %s - %s", g.Timeline, g.Start, g.End)
+	}
+
+	histories, err := readHistories(backend)
+	if err != nil {
+		return err
+	}
+	checkTimelines(ranges, histories, problem)
+
+	if download {
+		for _, r := range ranges {
+			err := verifyWalRange(backend, r, problem)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	if problems > 0 {
+		return fmt.Errorf("verify wal: %d problems", problems)
+	}
+	out("ok")
+	return nil
+}
+
+func historyFile(timeline int) string {
+	return fmt.Sprintf("%08x.history", timeline)
+}
+
+// historyEntry is a line of a timeline history file: the timeline branched
+// off Timeline at Lsn
+type historyEntry struct {
+	Timeline int
+	Lsn      LSN
+}
+
+// parseHistory parses a timeline history file, which lists the switches
+// of all earlier timelines, the parent last
+func parseHistory(d []byte) ([]historyEntry, error) {
+	var h []historyEntry
+	for _, line := range strings.Split(string(d), "\n") {
+		f := strings.Fields(line)
+		if len(f) == 0 || strings.HasPrefix(f[0], "#") {
+			continue
+		}
+		var e historyEntry
+		var err error
+		e.Timeline, err = strconv.Atoi(f[0])
+		if err == nil && len(f) > 1 {
+			e.Lsn, err = ParseLSN(f[1])
+		}
+		if err != nil || len(f) < 2 || e.Timeline <= 0 {
+			return nil, errors.New("invalid history line: " + line)
+		}
+		h = append(h, e)
+	}
+	return h, nil
+}
+
+// readHistories downloads the history files in storage, by timeline
+func readHistories(backend *Backend) (map[int][]historyEntry, error) {
+	files, err := backend.List("history")
+	if err != nil {
+		return nil, err
+	}
+	histories := map[int][]historyEntry{}
+	err = backend.GetAll(files, func(f string, d []byte, err error) error {
+		if err != nil {
+			return fmt.Errorf("%s: %s", f, err)
+		}
+		var timeline int
+		if n, _ := fmt.Sscanf(f, "%08x.history", &timeline); n != 1 {
+			return nil
+		}
+		aesStream(f).XORKeyStream(d, d)
+		h, err := parseHistory(d)
+		if err != nil {
+			return fmt.Errorf("%s: %s", f, err)
+		}
+		histories[timeline] = h
+		return nil
+	})
+	return histories, err
+}
+
+// checkTimelines checks that the wal of each timeline leads up to where the
+// next one branched off it, by the switch points in the history files. What
+// the parent did after that, like the old primary after a point in time
+// recovery, doesn't matter.
+func checkTimelines(ranges []walRange, histories map[int][]historyEntry, problem func(string, ...interface{})) {
+	seen := map[int]bool{}
+	for _, r := range ranges {
+		if seen[r.Timeline] {
+			continue
+		}
+		seen[r.Timeline] = true // r is the first range of the timeline
+		h := histories[r.Timeline]
+		if len(h) == 0 {
+			if r.Timeline != ranges[0].Timeline {
+				out("timeline %d: no history file, not checking where it branched off", r.Timeline)
+			}
+			continue
+		}
+		sw := h[len(h)-1]
+		first := sw.Lsn &^ (segmentSize - 1) // the new timeline starts with this segment
+
+		var before, parent bool
+		var end LSN
+		for _, p := range ranges {
+			if p.Timeline != sw.Timeline || p.Start > first {
+				continue
+			}
+			before = true
+			end = p.End
+			if p.End >= first {
+				parent = true
+			}
+		}
+		switch {
+		case before && !parent:
+			problem("timeline %d ends at %s, before timeline %d branched off it at %s", sw.Timeline, end, r.Timeline, sw.Lsn)
+		case parent && r.Start > first:
+			problem("timeline %d: missing wal %s - %s after branching off timeline %d", r.Timeline, first, r.Start, sw.Timeline)
+		case !before && r.Start == first && r.Timeline != ranges[0].Timeline:
+			problem("timeline %d starts at %s without wal of timeline %d leading up to it", r.Timeline, r.Start, sw.Timeline)
+		}
+	}
+}
+
+// verifyWalRange downloads and decodes all segments in r
+func verifyWalRange(backend *Backend, r walRange, problem func(string, ...interface{})) error {
+	var files []string
+	for lsn := r.Start; lsn < r.End; lsn += segmentSize {
+		files = append(files, walSegment{uint64(lsn) >> 24, r.Timeline}.File())
+	}
+
+	var dec *wal.Decoder
+	lsn := r.Start
+	return backend.GetAll(files, func(file string, d []byte, err error) error {
+		defer func() { lsn += segmentSize }()
+		last := lsn+segmentSize == r.End
+		slog.Debug("verify segment", "segment", segmentName(r.Timeline, lsn), "lsn", lsn)
+
+		if err != nil {
+			problem("timeline %d: %s: %s", r.Timeline, lsn, err)
+			dec = nil
+			return nil
+		}
+		if len(d) < segmentSize && !last {
+			problem("timeline %d: %s: truncated segment of %d bytes", r.Timeline, lsn, len(d))
+		}
+
+		if dec == nil {
+			dec = wal.NewDecoder(uint64(lsn))
+			dec.SystemId = config.SystemId
+			dec.Timeline = uint32(r.Timeline)
+		}
+		aesStream(file).XORKeyStream(d, d)
+		_, err = dec.Write(d)
+		if err != nil {
+			if _, ok := err.(*wal.Error); !ok {
+				return err
+			}
+			problem("timeline %d: %s", r.Timeline, err)
+			dec = nil // start over at the next segment
+			return nil
+		}
+
+		if dec.End != 0 && !last {
+			problem("timeline %d: %s: wal ends before the end of the range", r.Timeline, LSN(dec.End))
+			dec = nil
+		}
+		if len(d) < segmentSize {
+			dec = nil // the next segment doesn't continue where this one stops
+		}
+		return nil
+	})
+}
+
+// backupManifest is the backup_manifest the server writes with MANIFEST
+// https://www.postgresql.org/docs/current/backup-manifest-format.html
+type backupManifest struct {
+	Version  int    `json:"PostgreSQL-Backup-Manifest-Version"`
+	SystemId uint64 `json:"System-Identifier"` // since version 2 (postgres 17)
+	Files    []struct {
+		Path        string `json:"Path"`
+		EncodedPath string `json:"Encoded-Path"` // hex, for names that aren't utf8
+		Size        int64  `json:"Size"`
+		Algorithm   string `json:"Checksum-Algorithm"`
+		Checksum    string `json:"Checksum"`
+	} `json:"Files"`
+	WalRanges []struct {
+		Timeline int `json:"Timeline"`
+		Start    LSN `json:"Start-LSN"`
+		End      LSN `json:"End-LSN"`
+	} `json:"WAL-Ranges"`
+	Checksum string `json:"Manifest-Checksum"`
+}
+
+// manifestChecksum returns the sha256 of the manifest up to its last line,
+// which holds the checksum itself
+func manifestChecksum(d []byte) (string, bool) {
+	end := bytes.LastIndexByte(bytes.TrimRight(d, "\n"), '\n')
+	if end < 0 {
+		return "", false
+	}
+	sum := sha256.Sum256(d[:end+1])
+	return hex.EncodeToString(sum[:]), true
+}
+
+// fileChecksum starts a checksum of a manifest algorithm
+func fileChecksum(algorithm string) (hash.Hash, bool) {
+	switch algorithm {
+	case "CRC32C":
+		return crc32.New(crc32.MakeTable(crc32.Castagnoli)), true
+	case "SHA224":
+		return sha256.New224(), true
+	case "SHA256":
+		return sha256.New(), true
+	case "SHA384":
+		return sha512.New384(), true
+	case "SHA512":
+		return sha512.New(), true
+	}
+	return nil, false
+}
+
+// checksumString formats h like the manifest does, crc32c is in the byte
+// order of the server (assumed little endian)
+func checksumString(h hash.Hash, algorithm string) string {
+	sum := h.Sum(nil)
+	if algorithm == "CRC32C" {
+		sum[0], sum[1], sum[2], sum[3] = sum[3], sum[2], sum[1], sum[0]
+	}
+	return hex.EncodeToString(sum)
+}
+
+// VerifyBase checks a base backup against its manifest, like pg_verifybackup:
+// the manifest checksum, the size and checksum of every file in the
+// archives, and that the wal it needs is in storage
+func VerifyBase(id string) error {
+	backend, err := Connect()
+	if err != nil {
+		return err
+	}
+	defer backend.Close()
+
+	bases, err := listBases(backend, false)
+	if err != nil {
+		return err
+	}
+	base, err := findBase(bases, id)
+	if err != nil {
+		return err
+	}
+	if base.Manifest == "" {
+		return fmt.Errorf("%s has no manifest, take base backups with --manifest", base.File)
+	}
+	out("base %s: %s - %s, timeline %d", base.File, base.StartLsn, base.EndLsn, base.Timeline)
+
+	var problems int
+	problem := func(s string, args ...interface{}) {
+		problems++
+		out("BAD "+s, args...)
+	}
+
+	d, err := getManifest(backend, base)
+	if err != nil {
+		return err
+	}
+	var manifest backupManifest
+	if err := json.Unmarshal(d, &manifest); err != nil {
+		return fmt.Errorf("%s: %s", base.Manifest, err)
+	}
+	if sum, ok := manifestChecksum(d); !ok || sum != manifest.Checksum {
+		problem("manifest checksum mismatch")
+	}
+	if manifest.SystemId != 0 && manifest.SystemId != config.SystemId {
+		problem("manifest is of system %d", manifest.SystemId)
+	}
+
+	type manifestFile struct {
+		size      int64
+		algorithm string
+		checksum  string
+		seen      bool
+	}
+	files := map[string]*manifestFile{}
+	for _, f := range manifest.Files {
+		path := f.Path
+		if f.EncodedPath != "" {
+			p, err := hex.DecodeString(f.EncodedPath)
+			if err != nil {
+				return fmt.Errorf("%s: %s", base.Manifest, err)
+			}
+			path = string(p)
+		}
+		files[path] = &manifestFile{size: f.Size, algorithm: f.Algorithm, checksum: f.Checksum}
+	}
+
+	// wal in the archive, from basebackup --wal
+	segments := map[string]bool{}
+
+	for _, ts := range base.Tablespaces {
+		prefix := ""
+		if ts.Oid != "" {
+			prefix = "pg_tblspc/" + ts.Oid + "/"
+		}
+		file := archiveFile(base, ts.Oid)
+		slog.Debug("verify archive", "file", file)
+
+		rd, err := openArchive(backend, base, file)
+		if err != nil {
+			problem("%s: %s", file, err)
+			continue
+		}
+		tr := tar.NewReader(rd)
+		for {
+			h, err := tr.Next()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				problem("%s: %s", file, err)
+				break
+			}
+			if h.Typeflag != tar.TypeReg {
+				continue
+			}
+			path := prefix + strings.TrimPrefix(h.Name, "./")
+			if strings.HasPrefix(path, "pg_wal/") {
+				segments[strings.TrimPrefix(path, "pg_wal/")] = true
+				continue
+			}
+			f := files[path]
+			if f == nil {
+				problem("%s: %s is not in the manifest", file, path)
+				continue
+			}
+			f.seen = true
+			if h.Size != f.size {
+				problem("%s: %s has size %d instead of %d", file, path, h.Size, f.size)
+				continue
+			}
+			hs, ok := fileChecksum(f.algorithm)
+			if !ok {
+				hs = crc32.NewIEEE() // NONE, just read it
+			}
+			n, err := io.Copy(hs, tr)
+			if err != nil {
+				problem("%s: %s: %s", file, path, err)
+				break
+			}
+			if n != f.size {
+				problem("%s: %s is truncated at %d bytes", file, path, n)
+			} else if ok && checksumString(hs, f.algorithm) != strings.ToLower(f.checksum) {
+				problem("%s: %s checksum mismatch", file, path)
+			}
+		}
+		_, err = io.Copy(ioutil.Discard, rd)
+		if err != nil {
+			return err
+		}
+	}
+	for path, f := range files {
+		if !f.seen {
+			problem("%s is missing from the archives", path)
+		}
+	}
+
+	walFiles, err := backend.List("wal")
+	if err != nil {
+		return err
+	}
+	stored := map[walSegment]bool{}
+	for _, s := range parseWalList(walFiles) {
+		stored[s] = true
+	}
+	for _, r := range manifest.WalRanges {
+		for segment := uint64(r.Start) >> 24; segment <= uint64(r.End-1)>>24; segment++ {
+			s := walSegment{segment, r.Timeline}
+			if !stored[s] && !segments[segmentName(r.Timeline, s.Lsn())] {
+				problem("timeline %d: missing wal %s", r.Timeline, segmentName(r.Timeline, s.Lsn()))
+			}
+		}
+	}
+
+	if problems > 0 {
+		return fmt.Errorf("verify base: %d problems", problems)
+	}
+	out("ok, %d files", len(files))
+	return nil
+}
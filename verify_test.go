@@ -0,0 +1,117 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"strings"
+	"testing"
+
+	"./wal"
+)
+
+// testSegment is an empty wal segment of our system at lsn, just page
+// headers
+func testSegment(lsn LSN) []byte {
+	d := make([]byte, segmentSize)
+	for p := 0; p < segmentSize; p += 8192 {
+		binary.LittleEndian.PutUint16(d[p:], 0xd113)
+		binary.LittleEndian.PutUint32(d[p+4:], 1)
+		binary.LittleEndian.PutUint64(d[p+8:], uint64(lsn)+uint64(p))
+	}
+	binary.LittleEndian.PutUint16(d[2:], wal.LongHeader)
+	binary.LittleEndian.PutUint64(d[24:], config.SystemId)
+	binary.LittleEndian.PutUint32(d[32:], segmentSize)
+	binary.LittleEndian.PutUint32(d[36:], 8192)
+	return d
+}
+
+// testSpanning builds n segments from lsn that hold one record, which
+// goes on beyond them
+func testSpanning(lsn LSN, n int) [][]byte {
+	rem := uint32(n+1) * segmentSize
+	var segs [][]byte
+	for i := 0; i < n; i++ {
+		d := testSegment(lsn + LSN(i*segmentSize))
+		for p := 0; p < segmentSize; p += wal.PageSize {
+			pos := p + wal.ShortHeaderSize
+			if p == 0 {
+				pos = p + wal.LongHeaderSize
+			}
+			if i == 0 && p == 0 {
+				binary.LittleEndian.PutUint32(d[pos:], rem)
+			} else {
+				binary.LittleEndian.PutUint16(d[p+2:], binary.LittleEndian.Uint16(d[p+2:])|wal.FirstIsContRecord)
+				binary.LittleEndian.PutUint32(d[p+16:], rem)
+			}
+			rem -= uint32(p + wal.PageSize - pos)
+		}
+		segs = append(segs, d)
+	}
+	return segs
+}
+
+func TestVerifyWal(t *testing.T) {
+	b := startBackend(t)
+	segs := testSpanning(5<<24, 3)
+	for i, d := range segs {
+		b.putEncrypted(walSegment{uint64(5 + i), 1}.File(), d)
+	}
+	out, err := stdout(func() error { return VerifyWal(true) })
+	if err != nil {
+		t.Fatalf("%s: %s", err, out)
+	}
+
+	// the segment after a truncated one is decoded on its own
+	b.putEncrypted(walSegment{6, 1}.File(), segs[1][:3*wal.PageSize])
+	out, err = stdout(func() error { return VerifyWal(true) })
+	if err == nil || err.Error() != "verify wal: 1 problems" || !strings.Contains(string(out), "truncated segment of 24576 bytes") {
+		t.Errorf("%v: %s", err, out)
+	}
+}
+
+func TestCheckTimelines(t *testing.T) {
+	var segs []walSegment
+	add := func(timeline int, from, to uint64) {
+		for s := from; s < to; s++ {
+			segs = append(segs, walSegment{s, timeline})
+		}
+	}
+	add(1, 1, 11) // continued after timeline 2 branched off, like after pitr
+	add(2, 5, 9)
+	add(3, 9, 13) // from timeline 1, not 2
+	add(4, 10, 12)
+	add(5, 12, 14)
+	add(6, 20, 21)
+	histories := map[int][]historyEntry{}
+	for tl, h := range map[int]string{
+		2: "1\t0/5800000\tbefore 2000-01-01 00:00:00+00\n",
+		3: "1\t0/9000100\tno recovery target specified\n",
+		4: "1\t0/5800000\tbefore 2000-01-01 00:00:00+00\n\n2\t0/A000000\tno recovery target specified\n",
+		5: "1\t0/9000100\tno recovery target specified\n3\t0/B000000\tno recovery target specified\n",
+	} {
+		var err error
+		histories[tl], err = parseHistory([]byte(h))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if h := histories[4]; len(h) != 2 || h[1] != (historyEntry{2, 0xA000000}) {
+		t.Fatalf("history %+v", h)
+	}
+	if _, err := parseHistory([]byte("1\tnot an lsn\n")); err == nil {
+		t.Error("parsed an invalid history")
+	}
+
+	ranges, _ := walRanges(segs)
+	var problems []string
+	checkTimelines(ranges, histories, func(s string, args ...interface{}) {
+		problems = append(problems, fmt.Sprintf(s, args...))
+	})
+	want := []string{
+		"timeline 2 ends at 0/09000000, before timeline 4 branched off it at 0/0a000000",
+		"timeline 5: missing wal 0/0b000000 - 0/0c000000 after branching off timeline 3",
+	}
+	if strings.Join(problems, "\n") != strings.Join(want, "\n") {
+		t.Errorf("problems %q", problems)
+	}
+}
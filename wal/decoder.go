@@ -0,0 +1,316 @@
+package wal
+
+// decodes the postgresql write ahead log, page by page, into records
+// https://github.com/postgres/postgres/blob/master/src/include/access/xlogrecord.h
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+)
+
+const (
+	PageSize    = 8192
+	SegmentSize = 0x1000000
+
+	ShortHeaderSize  = 24 // MAXALIGN(sizeof(XLogPageHeaderData))
+	LongHeaderSize   = 40 // MAXALIGN(sizeof(XLogLongPageHeaderData))
+	RecordHeaderSize = 24 // sizeof(XLogRecord)
+
+	FirstIsContRecord = 0x0001 // xlp_info flags
+	LongHeader        = 0x0002
+
+	RmXlog     = 0    // resource manager of xlog internal records
+	XlogSwitch = 0x40 // xl_info of the record ending a segment early
+)
+
+const maxRecordSize = 1020 * 1024 * 1024 // XLogRecordMaxSize
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+// PageHeader is XLogPageHeaderData, the long header fields are only set on
+// the first page of a segment
+type PageHeader struct {
+	Magic    uint16
+	Info     uint16
+	Timeline uint32
+	PageAddr uint64
+	RemLen   uint32
+
+	SystemId  uint64
+	SegSize   uint32
+	BlockSize uint32
+}
+
+func ParsePageHeader(p []byte) (*PageHeader, error) {
+	if len(p) < ShortHeaderSize {
+		return nil, errors.New("short page header")
+	}
+	h := &PageHeader{
+		Magic:    binary.LittleEndian.Uint16(p[0:]),
+		Info:     binary.LittleEndian.Uint16(p[2:]),
+		Timeline: binary.LittleEndian.Uint32(p[4:]),
+		PageAddr: binary.LittleEndian.Uint64(p[8:]),
+		RemLen:   binary.LittleEndian.Uint32(p[16:]),
+	}
+	if h.Info&LongHeader != 0 {
+		if len(p) < LongHeaderSize {
+			return nil, errors.New("short long page header")
+		}
+		h.SystemId = binary.LittleEndian.Uint64(p[24:])
+		h.SegSize = binary.LittleEndian.Uint32(p[32:])
+		h.BlockSize = binary.LittleEndian.Uint32(p[36:])
+	}
+	return h, nil
+}
+
+func (h *PageHeader) Size() int {
+	if h.Info&LongHeader != 0 {
+		return LongHeaderSize
+	}
+	return ShortHeaderSize
+}
+
+// Record is a (reassembled) XLogRecord
+type Record struct {
+	Lsn    uint64
+	TotLen uint32
+	Xid    uint32
+	Prev   uint64
+	Info   uint8
+	Rmid   uint8
+	Crc    uint32
+	Raw    []byte // the complete record, header included
+	Magic  uint16 // xlp_magic of its pages, which tells the postgres version
+}
+
+func (r *Record) End() uint64 {
+	return r.Lsn + uint64(r.TotLen)
+}
+
+// CheckCRC verifies xl_crc, computed over the record data and then the
+// header up to xl_crc
+func (r *Record) CheckCRC() bool {
+	crc := crc32.Update(0, castagnoli, r.Raw[RecordHeaderSize:])
+	crc = crc32.Update(crc, castagnoli, r.Raw[:20])
+	return crc == r.Crc
+}
+
+// Error is a problem found in the wal at Lsn
+type Error struct {
+	Lsn uint64
+	Msg string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("%X/%08X: %s", e.Lsn>>32, uint32(e.Lsn), e.Msg)
+}
+
+// Decoder takes the wal written to it, starting at a page boundary, and
+// calls OnPage and OnRecord for every page and record in it. It buffers up
+// to a full page, so records are only decoded once their last page is
+// complete.
+type Decoder struct {
+	Lsn      uint64 // start of the page being buffered
+	SystemId uint64 // if set, checked against the long page headers
+	Timeline uint32 // if set, the highest timeline expected in page headers
+
+	OnPage   func(lsn uint64, h *PageHeader) error
+	OnRecord func(r *Record) error
+
+	End uint64 // if set, where valid wal ends (zeroes follow)
+
+	page  []byte
+	first uint64 // a continuation record on this page is skipped
+	magic uint16
+
+	skip   uint32 // continuation bytes of a record started before our first page
+	rec    []byte // record being reassembled
+	recLsn uint64
+	recLen uint32
+	toNext bool // skip to the next segment, after an xlog switch
+}
+
+func NewDecoder(lsn uint64) *Decoder {
+	lsn &^= PageSize - 1
+	return &Decoder{Lsn: lsn, first: lsn, page: make([]byte, 0, PageSize)}
+}
+
+// Pos returns the position of the next byte to be written
+func (d *Decoder) Pos() uint64 {
+	return d.Lsn + uint64(len(d.page))
+}
+
+func (d *Decoder) Write(p []byte) (int, error) {
+	n := len(p)
+	for len(p) > 0 {
+		c := PageSize - len(d.page)
+		if c > len(p) {
+			c = len(p)
+		}
+		d.page = append(d.page, p[:c]...)
+		p = p[c:]
+		if len(d.page) == PageSize {
+			err := d.decodePage(d.page)
+			d.page = d.page[:0]
+			d.Lsn += PageSize
+			if err != nil {
+				return n - len(p), err
+			}
+		}
+	}
+	return n, nil
+}
+
+func (d *Decoder) errorf(lsn uint64, s string, args ...interface{}) error {
+	return &Error{Lsn: lsn, Msg: fmt.Sprintf(s, args...)}
+}
+
+func (d *Decoder) decodePage(p []byte) error {
+	lsn := d.Lsn
+	if lsn%SegmentSize == 0 {
+		d.toNext = false
+	}
+	if d.End != 0 || d.toNext {
+		return nil
+	}
+
+	h, err := ParsePageHeader(p)
+	if err != nil {
+		return d.errorf(lsn, "%s", err)
+	}
+	if h.Magic == 0 && h.PageAddr == 0 {
+		if d.rec != nil {
+			return d.errorf(lsn, "wal ends within record at %X/%08X", d.recLsn>>32, uint32(d.recLsn))
+		}
+		d.End = lsn
+		return nil
+	}
+
+	if h.Magic < 0xd000 || h.Magic > 0xd1ff || (d.magic != 0 && h.Magic != d.magic) {
+		return d.errorf(lsn, "invalid xlp_magic %04X", h.Magic)
+	}
+	d.magic = h.Magic
+	if h.PageAddr != lsn {
+		return d.errorf(lsn, "xlp_pageaddr %X/%08X, expected page at %X/%08X", h.PageAddr>>32, uint32(h.PageAddr), lsn>>32, uint32(lsn))
+	}
+	if d.Timeline != 0 && h.Timeline > d.Timeline {
+		return d.errorf(lsn, "xlp_tli %d beyond timeline %d", h.Timeline, d.Timeline)
+	}
+	if lsn%SegmentSize == 0 {
+		if h.Info&LongHeader == 0 {
+			return d.errorf(lsn, "no long header on first page of segment")
+		}
+		if d.SystemId != 0 && h.SystemId != d.SystemId {
+			return d.errorf(lsn, "xlp_sysid %d, expected %d", h.SystemId, d.SystemId)
+		}
+		if h.SegSize != SegmentSize || h.BlockSize != PageSize {
+			return d.errorf(lsn, "unsupported segment size %d or block size %d", h.SegSize, h.BlockSize)
+		}
+	}
+	if d.OnPage != nil {
+		if err := d.OnPage(lsn, h); err != nil {
+			return err
+		}
+	}
+
+	pos := h.Size()
+	cont := h.Info&FirstIsContRecord != 0
+	switch {
+	case d.rec != nil || d.skip > 0:
+		want := d.skip
+		if d.rec != nil {
+			want = d.recLen - uint32(len(d.rec))
+		}
+		if !cont || h.RemLen != want {
+			return d.errorf(lsn, "expected continuation of %d bytes, got xlp_rem_len %d", want, h.RemLen)
+		}
+	case cont:
+		if lsn != d.first {
+			return d.errorf(lsn, "unexpected continuation record")
+		}
+		d.skip = h.RemLen // record started before our first page
+	}
+
+	if d.skip > 0 {
+		c := PageSize - pos
+		if uint32(c) >= d.skip {
+			c = int(d.skip)
+		}
+		d.skip -= uint32(c)
+		pos = align(pos + c)
+		if d.skip > 0 {
+			return nil
+		}
+	}
+
+	for pos < PageSize {
+		if d.rec == nil {
+			if PageSize-pos < 4 {
+				break
+			}
+			totLen := binary.LittleEndian.Uint32(p[pos:])
+			if totLen == 0 {
+				d.End = lsn + uint64(pos) // end of wal, rest of page is zeroes
+				return nil
+			}
+			if totLen < RecordHeaderSize || totLen > maxRecordSize {
+				return d.errorf(lsn+uint64(pos), "invalid record length %d", totLen)
+			}
+			d.recLsn = lsn + uint64(pos)
+			d.recLen = totLen
+			d.rec = make([]byte, 0, totLen)
+		}
+
+		c := int(d.recLen) - len(d.rec)
+		if c > PageSize-pos {
+			c = PageSize - pos
+		}
+		d.rec = append(d.rec, p[pos:pos+c]...)
+		pos += c
+		if len(d.rec) < int(d.recLen) {
+			break // continues on next page
+		}
+
+		err := d.record()
+		if err != nil {
+			return err
+		}
+		if d.toNext {
+			return nil
+		}
+		pos = align(pos)
+	}
+	return nil
+}
+
+func (d *Decoder) record() error {
+	b := d.rec
+	r := &Record{
+		Lsn:    d.recLsn,
+		TotLen: binary.LittleEndian.Uint32(b[0:]),
+		Xid:    binary.LittleEndian.Uint32(b[4:]),
+		Prev:   binary.LittleEndian.Uint64(b[8:]),
+		Info:   b[16],
+		Rmid:   b[17],
+		Crc:    binary.LittleEndian.Uint32(b[20:]),
+		Raw:    b,
+		Magic:  d.magic,
+	}
+	d.rec = nil
+	if !r.CheckCRC() {
+		return d.errorf(r.Lsn, "incorrect record crc")
+	}
+	if r.Rmid == RmXlog && r.Info&0xf0 == XlogSwitch {
+		d.toNext = true // rest of segment is unused
+	}
+	if d.OnRecord != nil {
+		return d.OnRecord(r)
+	}
+	return nil
+}
+
+func align(n int) int {
+	return (n + 7) &^ 7
+}
@@ -0,0 +1,232 @@
+package wal
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"testing"
+)
+
+const testMagic = 0xd113 // pg16
+
+// testRecord builds an XLogRecord with body after its header
+func testRecord(rmid, info uint8, prev uint64, body []byte) []byte {
+	r := make([]byte, RecordHeaderSize+len(body))
+	binary.LittleEndian.PutUint32(r[0:], uint32(len(r)))
+	binary.LittleEndian.PutUint32(r[4:], 1000)
+	binary.LittleEndian.PutUint64(r[8:], prev)
+	r[16] = info
+	r[17] = rmid
+	copy(r[RecordHeaderSize:], body)
+	crc := crc32.Update(0, castagnoli, r[RecordHeaderSize:])
+	crc = crc32.Update(crc, castagnoli, r[:20])
+	binary.LittleEndian.PutUint32(r[20:], crc)
+	return r
+}
+
+// testWal lays out recs on pages from start, a segment boundary, like
+// postgres does: records are aligned, and continue after the header of
+// the next page. It returns the pages and where each record starts.
+func testWal(start uint64, pages int, recs ...[]byte) ([]byte, []uint64) {
+	d := make([]byte, pages*PageSize)
+	header := func(pos int, rem int) int {
+		p := d[pos:]
+		binary.LittleEndian.PutUint16(p[0:], testMagic)
+		binary.LittleEndian.PutUint32(p[4:], 1)
+		binary.LittleEndian.PutUint64(p[8:], start+uint64(pos))
+		binary.LittleEndian.PutUint32(p[16:], uint32(rem))
+		if rem > 0 {
+			binary.LittleEndian.PutUint16(p[2:], FirstIsContRecord)
+		}
+		if (start+uint64(pos))%SegmentSize != 0 {
+			return pos + ShortHeaderSize
+		}
+		p[2] |= LongHeader
+		binary.LittleEndian.PutUint64(p[24:], 7)
+		binary.LittleEndian.PutUint32(p[32:], SegmentSize)
+		binary.LittleEndian.PutUint32(p[36:], PageSize)
+		return pos + LongHeaderSize
+	}
+
+	var lsns []uint64
+	pos := header(0, 0)
+	for p := PageSize; p < len(d); p += PageSize {
+		header(p, 0)
+	}
+	for _, r := range recs {
+		if pos%PageSize == 0 {
+			pos = header(pos, 0)
+		}
+		lsns = append(lsns, start+uint64(pos))
+		for len(r) > 0 {
+			if pos%PageSize == 0 {
+				pos = header(pos, len(r))
+			}
+			n := copy(d[pos:pos+PageSize-pos%PageSize], r)
+			r = r[n:]
+			pos += n
+		}
+		pos = align(pos)
+	}
+	return d, lsns
+}
+
+// decodeAll writes d to dec in pieces that don't line up with pages
+func decodeAll(dec *Decoder, d []byte) ([]*Record, error) {
+	var recs []*Record
+	dec.OnRecord = func(r *Record) error {
+		recs = append(recs, r)
+		return nil
+	}
+	for len(d) > 0 {
+		n := 1000
+		if n > len(d) {
+			n = len(d)
+		}
+		if _, err := dec.Write(d[:n]); err != nil {
+			return recs, err
+		}
+		d = d[n:]
+	}
+	return recs, nil
+}
+
+func TestDecoder(t *testing.T) {
+	start := uint64(5 * SegmentSize)
+	big := bytes.Repeat([]byte("spans pages "), 1500) // 18000 bytes, over three pages
+	d, lsns := testWal(start, 4,
+		testRecord(RmXlog, 0x10, 0, []byte("checkpoint")),
+		testRecord(RmHeap, 0, start+LongHeaderSize, big),
+		testRecord(RmXact, XactCommit, 0, []byte("commit")),
+	)
+
+	dec := NewDecoder(start)
+	dec.SystemId = 7
+	dec.Timeline = 1
+	var pages []uint64
+	dec.OnPage = func(lsn uint64, h *PageHeader) error {
+		if h.Magic != testMagic || h.Timeline != 1 {
+			t.Errorf("page %X: %+v", lsn, h)
+		}
+		pages = append(pages, lsn)
+		return nil
+	}
+	recs, err := decodeAll(dec, d)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(recs) != 3 {
+		t.Fatalf("%d records", len(recs))
+	}
+	for i, r := range recs {
+		if r.Lsn != lsns[i] || r.Magic != testMagic || !r.CheckCRC() {
+			t.Errorf("record %d: %+v, want lsn %X", i, r, lsns[i])
+		}
+	}
+	if !bytes.Equal(recs[1].Raw[RecordHeaderSize:], big) || recs[1].Prev != start+LongHeaderSize || recs[1].End() != lsns[1]+uint64(len(big))+RecordHeaderSize {
+		t.Errorf("spanning record %X, %d bytes", recs[1].Lsn, len(recs[1].Raw))
+	}
+	if recs[1].End()/PageSize != start/PageSize+2 {
+		t.Errorf("record ends at %X, not on the third page", recs[1].End())
+	}
+	if len(pages) != 3 {
+		t.Errorf("pages %X", pages)
+	}
+	if dec.End != uint64(align(int(recs[2].End()))) {
+		t.Errorf("end %X after %X", dec.End, recs[2].End())
+	}
+	if dec.Pos() != start+uint64(len(d)) {
+		t.Errorf("pos %X", dec.Pos())
+	}
+}
+
+func TestDecoderCorrupt(t *testing.T) {
+	start := uint64(5 * SegmentSize)
+	big := bytes.Repeat([]byte("spans pages "), 1000)
+	recs := [][]byte{testRecord(RmXlog, 0x10, 0, []byte("checkpoint")), testRecord(RmHeap, 0, 0, big)}
+	good, lsns := testWal(start, 2, recs...)
+
+	for _, c := range []struct {
+		name  string
+		at    int // offset of the byte to change
+		to    byte
+		lsn   uint64
+		error string
+	}{
+		// on the second page, in the part of the record continued there
+		{"crc", PageSize + 100, 'x', lsns[1], "incorrect record crc"},
+		{"pageaddr", PageSize + 9, 0xff, start + PageSize, "xlp_pageaddr"},
+		{"magic", PageSize, 0, start + PageSize, "invalid xlp_magic"},
+		{"continuation", PageSize + 16, 1, start + PageSize, "expected continuation"},
+		{"length", int(lsns[1]-start) + 3, 0xff, lsns[1], "invalid record length"},
+	} {
+		d := append([]byte(nil), good...)
+		d[c.at] = c.to
+		got, err := decodeAll(NewDecoder(start), d)
+		var e *Error
+		if !errors.As(err, &e) || e.Lsn != c.lsn || !bytes.Contains([]byte(e.Msg), []byte(c.error)) {
+			t.Errorf("%s: %v, want %q at %X", c.name, err, c.error, c.lsn)
+		}
+		if len(got) != 1 {
+			t.Errorf("%s: decoded %d records", c.name, len(got))
+		}
+	}
+
+	// wal that ends within a record
+	d := append([]byte(nil), good[:PageSize]...)
+	d = append(d, make([]byte, PageSize)...)
+	if _, err := decodeAll(NewDecoder(start), d); err == nil || !bytes.Contains([]byte(err.Error()), []byte("ends within record")) {
+		t.Errorf("truncated: %v", err)
+	}
+}
+
+func TestDecoderMidRecord(t *testing.T) {
+	start := uint64(5 * SegmentSize)
+	big := bytes.Repeat([]byte("spans pages "), 1000)
+	d, lsns := testWal(start, 3,
+		testRecord(RmHeap, 0, 0, big),
+		testRecord(RmXact, XactCommit, 0, []byte("commit")),
+	)
+
+	// decoding from the second page skips the rest of the first record
+	recs, err := decodeAll(NewDecoder(start+PageSize), d[PageSize:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(recs) != 1 || recs[0].Lsn != lsns[1] {
+		t.Errorf("records %+v", recs)
+	}
+
+	// a continuation is only expected on the first page
+	dec := NewDecoder(start)
+	dec.Write(d[:PageSize])
+	dec.rec = nil // as if the decoder had lost the record
+	if _, err := dec.Write(d[PageSize : 2*PageSize]); err == nil {
+		t.Error("took a continuation for a record")
+	}
+}
+
+func TestDecoderSwitch(t *testing.T) {
+	start := uint64(5 * SegmentSize)
+	d, _ := testWal(start, 2, testRecord(RmXlog, XlogSwitch, 0, nil))
+	// the rest of the segment after a switch is garbage
+	for i := PageSize; i < len(d); i++ {
+		d[i] = 0xaa
+	}
+	next, lsns := testWal(start+SegmentSize, 1, testRecord(RmXact, XactCommit, 0, []byte("commit")))
+
+	dec := NewDecoder(start)
+	recs, err := decodeAll(dec, d)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dec.Lsn = start + SegmentSize // as if the pages in between had been written
+	more, err := decodeAll(dec, next)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(recs) != 1 || recs[0].Op() != "SWITCH" || len(more) != 1 || more[0].Lsn != lsns[0] {
+		t.Errorf("records %+v, %+v", recs, more)
+	}
+}
@@ -0,0 +1,284 @@
+package wal
+
+// decodes the block references and main data of an XLogRecord
+// https://github.com/postgres/postgres/blob/master/src/include/access/xlogrecord.h
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// resource managers, by RmgrId
+var RmgrNames = []string{"XLOG", "Transaction", "Storage", "CLOG", "Database", "Tablespace", "MultiXact", "RelMap", "Standby", "Heap2", "Heap", "Btree", "Hash", "Gin", "Gist", "Sequence", "SPGist", "BRIN", "CommitTs", "ReplicationOrigin", "Generic", "LogicalMessage"}
+
+const (
+	RmXact = 1
+	RmHeap = 10
+
+	XactOpMask         = 0x70 // xl_info of RmXact records
+	XactCommit         = 0x00
+	XactAbort          = 0x20
+	XactCommitPrepared = 0x30
+	XactAbortPrepared  = 0x40
+)
+
+// names of the xl_info operations of some resource managers, masked by
+// 0x70 or 0xf0
+var opNames = map[uint8]map[uint8]string{
+	0:  {0x00: "CHECKPOINT_SHUTDOWN", 0x10: "CHECKPOINT_ONLINE", 0x20: "NOOP", 0x30: "NEXTOID", 0x40: "SWITCH", 0x50: "BACKUP_END", 0x60: "PARAMETER_CHANGE", 0x70: "RESTORE_POINT", 0x80: "FPW_CHANGE", 0x90: "END_OF_RECOVERY", 0xa0: "FPI_FOR_HINT", 0xb0: "FPI", 0xd0: "OVERWRITE_CONTRECORD", 0xe0: "CHECKPOINT_REDO"},
+	1:  {0x00: "COMMIT", 0x10: "PREPARE", 0x20: "ABORT", 0x30: "COMMIT_PREPARED", 0x40: "ABORT_PREPARED", 0x50: "ASSIGNMENT", 0x60: "INVALIDATIONS"},
+	8:  {0x00: "LOCK", 0x10: "RUNNING_XACTS", 0x20: "INVALIDATIONS"},
+	10: {0x00: "INSERT", 0x10: "DELETE", 0x20: "UPDATE", 0x30: "TRUNCATE", 0x40: "HOT_UPDATE", 0x50: "CONFIRM", 0x60: "LOCK", 0x70: "INPLACE"},
+}
+
+const (
+	blockIdDataShort   = 255
+	blockIdDataLong    = 254
+	blockIdOrigin      = 253
+	blockIdToplevelXid = 252
+	maxBlockId         = 32
+
+	bkpBlockForkMask = 0x0f
+	bkpBlockHasImage = 0x10
+	bkpBlockHasData  = 0x20
+	bkpBlockWillInit = 0x40
+	bkpBlockSameRel  = 0x80
+
+	bkpImageHasHole = 0x01
+)
+
+var forkNames = []string{"main", "fsm", "vm", "init"}
+
+// RelFileNode identifies a relation file: tablespace, database, relation
+type RelFileNode struct {
+	Spc, Db, Rel uint32
+}
+
+func (r RelFileNode) String() string {
+	return fmt.Sprintf("%d/%d/%d", r.Spc, r.Db, r.Rel)
+}
+
+// BlockRef is a block referenced by a record, with an optional full page
+// image and/or data
+type BlockRef struct {
+	Id       uint8
+	Fork     uint8
+	Rel      RelFileNode
+	Block    uint32
+	WillInit bool
+
+	HasImage   bool
+	Compressed bool
+	HoleOffset uint16
+	HoleLength uint16
+	Image      []byte // as stored, possibly compressed and without hole
+
+	Data []byte
+}
+
+// Decoded is the contents of a record after its header
+type Decoded struct {
+	Blocks      []BlockRef
+	MainData    []byte
+	Origin      uint16
+	ToplevelXid uint32
+}
+
+var errShortRecord = errors.New("record too short")
+
+// Decode parses the block references and main data of r
+func (r *Record) Decode() (*Decoded, error) {
+	b := r.Raw[RecordHeaderSize:]
+	next := func(n int) ([]byte, error) {
+		if len(b) < n {
+			return nil, errShortRecord
+		}
+		v := b[:n]
+		b = b[n:]
+		return v, nil
+	}
+
+	var dec Decoded
+	var mainLen uint32
+	var rel RelFileNode
+	var imageLen, dataLen []int
+
+	// headers continue until all that remains is the data they announced
+	var total int
+	for len(b) > total {
+		id := b[0]
+		b = b[1:]
+		switch {
+		case id == blockIdDataShort:
+			v, err := next(1)
+			if err != nil {
+				return nil, err
+			}
+			mainLen = uint32(v[0])
+			total += int(mainLen)
+		case id == blockIdDataLong:
+			v, err := next(4)
+			if err != nil {
+				return nil, err
+			}
+			mainLen = binary.LittleEndian.Uint32(v)
+			total += int(mainLen)
+		case id == blockIdOrigin:
+			v, err := next(2)
+			if err != nil {
+				return nil, err
+			}
+			dec.Origin = binary.LittleEndian.Uint16(v)
+		case id == blockIdToplevelXid:
+			v, err := next(4)
+			if err != nil {
+				return nil, err
+			}
+			dec.ToplevelXid = binary.LittleEndian.Uint32(v)
+		case id <= maxBlockId:
+			v, err := next(3)
+			if err != nil {
+				return nil, err
+			}
+			flags := v[0]
+			blk := BlockRef{Id: id, Fork: flags & bkpBlockForkMask, WillInit: flags&bkpBlockWillInit != 0}
+			dl := int(binary.LittleEndian.Uint16(v[1:]))
+			il := 0
+			if flags&bkpBlockHasImage != 0 {
+				v, err := next(5)
+				if err != nil {
+					return nil, err
+				}
+				blk.HasImage = true
+				il = int(binary.LittleEndian.Uint16(v))
+				blk.HoleOffset = binary.LittleEndian.Uint16(v[2:])
+				info := v[4]
+				if r.Magic >= 0xd110 { // pg15 has pglz, lz4 and zstd flags
+					blk.Compressed = info&(0x04|0x08|0x10) != 0
+				} else {
+					blk.Compressed = info&0x02 != 0
+				}
+				if info&bkpImageHasHole != 0 {
+					if blk.Compressed {
+						v, err := next(2)
+						if err != nil {
+							return nil, err
+						}
+						blk.HoleLength = binary.LittleEndian.Uint16(v)
+					} else {
+						blk.HoleLength = uint16(PageSize - il)
+					}
+				}
+			}
+			if flags&bkpBlockSameRel == 0 {
+				v, err := next(12)
+				if err != nil {
+					return nil, err
+				}
+				rel = RelFileNode{binary.LittleEndian.Uint32(v), binary.LittleEndian.Uint32(v[4:]), binary.LittleEndian.Uint32(v[8:])}
+			}
+			blk.Rel = rel
+			v, err = next(4)
+			if err != nil {
+				return nil, err
+			}
+			blk.Block = binary.LittleEndian.Uint32(v)
+			dec.Blocks = append(dec.Blocks, blk)
+			imageLen = append(imageLen, il)
+			dataLen = append(dataLen, dl)
+			total += il + dl
+		default:
+			return nil, fmt.Errorf("invalid block id %d", id)
+		}
+	}
+
+	for i := range dec.Blocks {
+		var err error
+		if dec.Blocks[i].HasImage {
+			if dec.Blocks[i].Image, err = next(imageLen[i]); err != nil {
+				return nil, err
+			}
+		}
+		if dataLen[i] > 0 {
+			if dec.Blocks[i].Data, err = next(dataLen[i]); err != nil {
+				return nil, err
+			}
+		}
+	}
+	main, err := next(int(mainLen))
+	if err != nil {
+		return nil, err
+	}
+	dec.MainData = main
+	return &dec, nil
+}
+
+func (r *Record) Rmgr() string {
+	if int(r.Rmid) < len(RmgrNames) {
+		return RmgrNames[r.Rmid]
+	}
+	return fmt.Sprintf("rmgr%d", r.Rmid)
+}
+
+// Op names the operation of the record, eg INSERT or COMMIT
+func (r *Record) Op() string {
+	mask := uint8(0xf0)
+	if r.Rmid == RmXact || r.Rmid == RmHeap {
+		mask = 0x70
+	}
+	if n, ok := opNames[r.Rmid][r.Info&mask]; ok {
+		return n
+	}
+	return fmt.Sprintf("info 0x%02X", r.Info)
+}
+
+// XactTime returns the commit or abort time of a transaction record
+func (r *Record) XactTime(d *Decoded) (time.Time, bool) {
+	if r.Rmid != RmXact || len(d.MainData) < 8 {
+		return time.Time{}, false
+	}
+	switch r.Info & XactOpMask {
+	case XactCommit, XactAbort, XactCommitPrepared, XactAbortPrepared:
+		us := int64(binary.LittleEndian.Uint64(d.MainData))
+		return time.Date(2000, time.January, 1, 0, 0, 0, 0, time.UTC).Add(time.Duration(us) * time.Microsecond), true
+	}
+	return time.Time{}, false
+}
+
+// String formats r like pg_waldump does
+func (r *Record) String() string {
+	var s strings.Builder
+	d, err := r.Decode()
+	recLen := r.TotLen
+	if err == nil {
+		for _, b := range d.Blocks {
+			recLen -= uint32(len(b.Image))
+		}
+	}
+	fmt.Fprintf(&s, "rmgr: %-11s len (rec/tot): %6d/%6d, tx: %10d, lsn: %X/%08X, prev %X/%08X, desc: %s",
+		r.Rmgr(), recLen, r.TotLen, r.Xid, r.Lsn>>32, uint32(r.Lsn), r.Prev>>32, uint32(r.Prev), r.Op())
+	if err != nil {
+		fmt.Fprintf(&s, ", %s", err)
+		return s.String()
+	}
+	if t, ok := r.XactTime(d); ok {
+		fmt.Fprintf(&s, " %s", t.Format("2006-01-02 15:04:05.000000 MST"))
+	}
+	for _, b := range d.Blocks {
+		fmt.Fprintf(&s, ", blkref #%d: rel %s", b.Id, b.Rel)
+		if b.Fork != 0 && int(b.Fork) < len(forkNames) {
+			fmt.Fprintf(&s, " fork %s", forkNames[b.Fork])
+		}
+		fmt.Fprintf(&s, " blk %d", b.Block)
+		if b.HasImage {
+			s.WriteString(" FPW")
+			if b.Compressed {
+				s.WriteString(" (compressed)")
+			}
+		}
+	}
+	return s.String()
+}
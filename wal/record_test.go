@@ -0,0 +1,130 @@
+package wal
+
+import (
+	"bytes"
+	"encoding/binary"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testDecoded builds the body of a heap record: a full page image with a
+// hole and data for block 0, data for block 1 in the same relation, and
+// main data
+func testDecoded() []byte {
+	var b bytes.Buffer
+	le := func(v interface{}) { binary.Write(&b, binary.LittleEndian, v) }
+	b.WriteByte(0)
+	b.WriteByte(bkpBlockHasImage | bkpBlockHasData)
+	le(uint16(4))
+	le(uint16(8000)) // image length, the hole is 192 bytes
+	le(uint16(100))
+	b.WriteByte(bkpImageHasHole)
+	le([]uint32{1663, 5, 1259})
+	le(uint32(7))
+
+	b.WriteByte(1)
+	b.WriteByte(bkpBlockSameRel | bkpBlockHasData | 1) // fsm
+	le(uint16(2))
+	le(uint32(8))
+
+	b.WriteByte(blockIdDataShort)
+	b.WriteByte(3)
+
+	b.Write(bytes.Repeat([]byte{'i'}, 8000))
+	b.WriteString("data")
+	b.WriteString("fs")
+	b.WriteString("row")
+	return b.Bytes()
+}
+
+// decodeRecord puts raw on pages and decodes it from there
+func decodeRecord(t *testing.T, raw []byte) *Record {
+	start := uint64(5 * SegmentSize)
+	d, _ := testWal(start, len(raw)/PageSize+2, raw)
+	recs, err := decodeAll(NewDecoder(start), d)
+	if err != nil || len(recs) != 1 {
+		t.Fatalf("%d records, %v", len(recs), err)
+	}
+	return recs[0]
+}
+
+func TestRecordDecode(t *testing.T) {
+	body := testDecoded()
+	r := decodeRecord(t, testRecord(RmHeap, 0x40, 0, body))
+	d, err := r.Decode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(d.Blocks) != 2 || string(d.MainData) != "row" {
+		t.Fatalf("%+v", d)
+	}
+	b := d.Blocks[0]
+	if b.Rel != (RelFileNode{1663, 5, 1259}) || b.Block != 7 || b.Fork != 0 || !b.HasImage || b.Compressed || b.HoleOffset != 100 || b.HoleLength != 192 || len(b.Image) != 8000 || string(b.Data) != "data" {
+		t.Errorf("block 0 %+v", b)
+	}
+	b = d.Blocks[1]
+	if b.Id != 1 || b.Rel != d.Blocks[0].Rel || b.Block != 8 || b.Fork != 1 || b.HasImage || string(b.Data) != "fs" {
+		t.Errorf("block 1 %+v", b)
+	}
+
+	s := r.String()
+	for _, want := range []string{"rmgr: Heap ", "len (rec/tot):     68/  8068", "desc: HOT_UPDATE", "blkref #0: rel 1663/5/1259 blk 7 FPW", "blkref #1: rel 1663/5/1259 fork fsm blk 8"} {
+		if !strings.Contains(s, want) {
+			t.Errorf("%s: no %q", s, want)
+		}
+	}
+
+	// cut short, or with an unknown block id
+	for i, raw := range [][]byte{
+		testRecord(RmHeap, 0, 0, body[:len(body)-1]),
+		testRecord(RmHeap, 0, 0, body[:10]),
+		testRecord(RmHeap, 0, 0, []byte{blockIdDataLong, 1}),
+		testRecord(RmHeap, 0, 0, []byte{40, 0, 0, 0}),
+	} {
+		r := decodeRecord(t, raw)
+		if d, err := r.Decode(); err == nil {
+			t.Errorf("%d: decoded %+v", i, d)
+		}
+		if !strings.Contains(r.String(), "desc: INSERT, ") {
+			t.Errorf("%d: %s", i, r)
+		}
+	}
+}
+
+func TestRecordXactTime(t *testing.T) {
+	at := time.Date(2024, time.March, 1, 12, 30, 0, 0, time.UTC)
+	main := make([]byte, 8)
+	binary.LittleEndian.PutUint64(main, uint64(at.Sub(time.Date(2000, time.January, 1, 0, 0, 0, 0, time.UTC))/time.Microsecond))
+	body := append([]byte{blockIdToplevelXid, 9, 0, 0, 0, blockIdDataShort, 8}, main...)
+
+	for _, c := range []struct {
+		rmid, info uint8
+		op         string
+		ok         bool
+	}{
+		{RmXact, XactCommit, "COMMIT", true},
+		{RmXact, XactAbort | 0x80, "ABORT", true}, // flag bits outside the op
+		{RmXact, 0x10, "PREPARE", false},
+		{RmHeap, 0, "INSERT", false},
+		{30, 0, "info 0x00", false},
+	} {
+		r := decodeRecord(t, testRecord(c.rmid, c.info, 0, body))
+		d, err := r.Decode()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if d.ToplevelXid != 9 {
+			t.Errorf("toplevel xid %d", d.ToplevelXid)
+		}
+		if got, ok := r.XactTime(d); ok != c.ok || ok && !got.Equal(at) {
+			t.Errorf("%s %s: %s, %v", r.Rmgr(), r.Op(), got, ok)
+		}
+		if r.Op() != c.op {
+			t.Errorf("op %s, want %s", r.Op(), c.op)
+		}
+	}
+	if r := (&Record{Rmid: 30}); r.Rmgr() != "rmgr30" {
+		t.Errorf("rmgr %s", r.Rmgr())
+	}
+}
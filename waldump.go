@@ -0,0 +1,113 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"sort"
+
+	"./wal"
+)
+
+var errDumpDone = errors.New("done")
+
+// segmentTimelines picks the highest timeline available for every segment,
+// like recovery would, and returns the segments in order
+func segmentTimelines(segs []walSegment) []walSegment {
+	latest := map[uint64]int{}
+	for _, s := range segs {
+		if s.Timeline > latest[s.Segment] {
+			latest[s.Segment] = s.Timeline
+		}
+	}
+	var r []walSegment
+	for segment, timeline := range latest {
+		r = append(r, walSegment{segment, timeline})
+	}
+	sort.Slice(r, func(i, j int) bool { return r[i].Segment < r[j].Segment })
+	return r
+}
+
+// Waldump prints the wal records from lsn from up to to (both optional)
+// straight from storage, like pg_waldump
+func Waldump(from, to string) error {
+	lsn0, lsn1 := LSN(0), LSN(1<<64-1)
+	var err error
+	if from != "" {
+		if lsn0, err = ParseLSN(from); err != nil {
+			return err
+		}
+	}
+	if to != "" {
+		if lsn1, err = ParseLSN(to); err != nil {
+			return err
+		}
+	}
+
+	backend, err := Connect()
+	if err != nil {
+		return err
+	}
+	defer backend.Close()
+
+	files, err := backend.List("wal")
+	if err != nil {
+		return err
+	}
+
+	var segs []walSegment
+	var get []string
+	for _, s := range segmentTimelines(parseWalList(files)) {
+		if s.Lsn()+segmentSize <= lsn0 {
+			continue
+		}
+		if s.Lsn() >= lsn1 {
+			break
+		}
+		segs = append(segs, s)
+		get = append(get, s.File())
+	}
+
+	var dec *wal.Decoder
+	var next LSN
+	err = backend.GetAll(get, func(file string, d []byte, err error) error {
+		s := segs[0]
+		segs = segs[1:]
+		if err != nil {
+			return fmt.Errorf("%s: %s", file, err)
+		}
+		if dec != nil && s.Lsn() != next {
+			fmt.Fprintf(os.Stdout, "missing wal %s - %s\n", next, s.Lsn())
+			dec = nil
+		}
+		next = s.Lsn() + segmentSize
+		if dec == nil {
+			dec = wal.NewDecoder(uint64(s.Lsn()))
+			dec.OnRecord = func(r *wal.Record) error {
+				if LSN(r.Lsn) >= lsn1 {
+					return errDumpDone
+				}
+				if LSN(r.Lsn) >= lsn0 {
+					fmt.Fprintln(os.Stdout, r)
+				}
+				return nil
+			}
+		}
+
+		slog.Debug("dump segment", "segment", segmentName(s.Timeline, s.Lsn()), "lsn", s.Lsn(), "timeline", s.Timeline)
+		aesStream(file).XORKeyStream(d, d)
+		_, err = dec.Write(d)
+		if err != nil {
+			return err
+		}
+		if dec.End != 0 {
+			return errDumpDone
+		}
+		return nil
+	})
+	if err == errDumpDone {
+		return nil
+	}
+	return err
+}